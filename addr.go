@@ -2,7 +2,12 @@ package edit
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"regexp"
+	"regexp/syntax"
+	"unicode/utf8"
 
 	"github.com/as/io/rev"
 	"github.com/as/text/find"
@@ -18,18 +23,26 @@ type Editor interface {
 	Close() error
 }
 
+// ErrSearch is returned when a regexp address doesn't
+// match anywhere in the text
+var ErrSearch = errors.New("search failed")
+
 // Address implements Set on the Editor. Possibly selecting
 // some range of text (a dot).
 type Address interface {
-	// Set computes and sets the address on the provided Editor
-	Set(f Editor)
+	// Set computes and sets the address on the provided Editor. If
+	// the address can't be computed, dot is unchanged and an error
+	// is returned.
+	Set(f Editor) error
 	// Back returns true if the address semantics should be executed in reverse
 	Back() bool
 }
 
-// Regexp is an address computed by a regexp
+// Regexp is an address computed by a regexp. A forward search
+// starts at the end of dot, a backward search at its start.
 type Regexp struct {
 	re   *regexp.Regexp
+	rev  *regexp.Regexp // re reversed, for backward searches
 	back bool
 	rel  int
 }
@@ -51,42 +64,47 @@ type Dot struct {
 	Q0, Q1 int64
 }
 
-type File struct {
-	Name string
-	Dot
-}
-
-// Compound combines two address values with an operator
+// Compound combines two address values with an operator. With
+// , or ; it selects the text from the start of a0 to the end of
+// a1. With + or -, a1 is evaluated relative to a0 in the
+// direction of the operator: a regexp is searched for forward
+// from the end of a0 or backward from its start, and the result
+// is a1 alone.
 type Compound struct {
 	a0, a1 Address
 	op     byte
 }
 
-func (r Regexp) Back() bool   { return r.rel == -1 }
+func (r Regexp) Back() bool   { return r.back }
 func (b Byte) Back() bool     { return b.rel == -1 }
 func (l Line) Back() bool     { return l.rel == -1 }
 func (d Dot) Back() bool      { return false }
 func (c Compound) Back() bool { return c.a1.Back() }
 
-func (c *Compound) Set(f Editor) {
+func (c *Compound) Set(f Editor) error {
 	if c.a0 == nil {
-		return
+		return nil
+	}
+	if err := c.a0.Set(f); err != nil {
+		return err
 	}
-	c.a0.Set(f)
 	q0, _ := f.Dot()
 
 	if c.a1 == nil {
-		return
+		return nil
 	}
-	c.a1.Set(f)
-	_, r1 := f.Dot()
-	if c.Back() {
-		return
+	if c.op == '+' || c.op == '-' {
+		return c.a1.Set(f)
+	}
+	if err := c.a1.Set(f); err != nil {
+		return err
 	}
+	_, r1 := f.Dot()
 	f.Select(q0, r1)
+	return nil
 }
 
-func (b *Byte) Set(f Editor) {
+func (b *Byte) Set(f Editor) error {
 	q0, q1 := f.Dot()
 	q := b.Q
 	if b.rel == -1 {
@@ -96,23 +114,106 @@ func (b *Byte) Set(f Editor) {
 	} else {
 		f.Select(q, q)
 	}
+	return nil
 }
-func (r *Regexp) Set(f Editor) {
+
+// Set selects the next match of the regexp. Like sam, if there
+// is no match between dot and the end of the text the search
+// wraps around and continues from the beginning.
+func (r *Regexp) Set(f Editor) error {
+	if r.back {
+		return r.setBack(f)
+	}
 	_, q1 := f.Dot()
 	org := q1
 	buf := bytes.NewReader(f.Bytes()[q1:])
 	loc := r.re.FindReaderIndex(buf)
 	if loc == nil {
-		return
+		org = 0
+		loc = r.re.FindIndex(f.Bytes())
+		if loc == nil {
+			return fmt.Errorf("%w: /%s/", ErrSearch, r.re)
+		}
 	}
 	r0, r1 := int64(loc[0])+org, int64(loc[1])+org
 	if r.rel == 1 {
 		//r0 = r1
 	}
 	f.Select(r0, r1)
+	return nil
+}
+
+// setBack selects the match that ends closest to the start
+// of dot without crossing it. The text before dot is read in
+// reverse by the reversed regexp, so the leftmost match it
+// finds is the rightmost match in the text. The search wraps
+// around to the end of the text.
+func (r *Regexp) setBack(f Editor) error {
+	q0, _ := f.Dot()
+	loc := r.rev.FindReaderIndex(&backReader{p: f.Bytes()[:q0]})
+	if loc == nil {
+		q0 = f.Len()
+		loc = r.rev.FindReaderIndex(&backReader{p: f.Bytes()})
+		if loc == nil {
+			return fmt.Errorf("%w: ?%s?", ErrSearch, r.re)
+		}
+	}
+	f.Select(q0-int64(loc[1]), q0-int64(loc[0]))
+	return nil
 }
 
-func (r *Line) Set(f Editor) {
+// reverseRegexp compiles a regexp that matches the reverse
+// of the text matched by expr
+func reverseRegexp(expr string) (*regexp.Regexp, error) {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	reverseSyntax(re)
+	return regexp.Compile(re.String())
+}
+
+func reverseSyntax(re *syntax.Regexp) {
+	switch re.Op {
+	case syntax.OpLiteral:
+		for i, j := 0, len(re.Rune)-1; i < j; i, j = i+1, j-1 {
+			re.Rune[i], re.Rune[j] = re.Rune[j], re.Rune[i]
+		}
+	case syntax.OpConcat:
+		for i, j := 0, len(re.Sub)-1; i < j; i, j = i+1, j-1 {
+			re.Sub[i], re.Sub[j] = re.Sub[j], re.Sub[i]
+		}
+	case syntax.OpBeginLine:
+		re.Op = syntax.OpEndLine
+	case syntax.OpEndLine:
+		re.Op = syntax.OpBeginLine
+	case syntax.OpBeginText:
+		re.Op = syntax.OpEndText
+	case syntax.OpEndText:
+		re.Op = syntax.OpBeginText
+	}
+	for _, sub := range re.Sub {
+		reverseSyntax(sub)
+	}
+}
+
+// backReader reads the runes in p from last to first. The
+// regexp package reads whole runes, so unlike rev.Reader it
+// doesn't reverse the bytes within a rune.
+type backReader struct {
+	p []byte
+}
+
+func (b *backReader) ReadRune() (r rune, size int, err error) {
+	if len(b.p) == 0 {
+		return 0, 0, io.EOF
+	}
+	r, size = utf8.DecodeLastRune(b.p)
+	b.p = b.p[:len(b.p)-size]
+	return r, size, nil
+}
+
+func (r *Line) Set(f Editor) error {
 	p := f.Bytes()
 	switch r.rel {
 	case 0:
@@ -120,21 +221,21 @@ func (r *Line) Set(f Editor) {
 		f.Select(q0, q1)
 	case 1:
 		_, org := f.Dot()
-		r.Q++
+		q := r.Q + 1
 		if org == 0 || p[org-1] == '\n' {
-			r.Q--
+			q--
 		}
 		p = p[org:]
-		q0, q1 := find.Findline2(r.Q, bytes.NewReader(p))
+		q0, q1 := find.Findline2(q, bytes.NewReader(p))
 		f.Select(q0+org, q1+org)
 	case -1:
 		org, _ := f.Dot()
-		r.Q = -r.Q + 1
+		q := -r.Q + 1
 		if org == 0 || p[org-1] == '\n' {
-			//r.Q--
+			//q--
 		}
 		p = p[:org]
-		q0, q1 := find.Findline2(r.Q, rev.NewReader(p)) // 0 = len(p)-1
+		q0, q1 := find.Findline2(q, rev.NewReader(p)) // 0 = len(p)-1
 		//fmt.Printf("Line.Set 1: %d:%d\n", q0, q1)
 		l := q1 - q0
 		q0 = org - q1
@@ -143,11 +244,17 @@ func (r *Line) Set(f Editor) {
 		if q0 >= 0 && q0 < int64(len(f.Bytes())) && f.Bytes()[q0] == '\n' {
 			q0++
 		}
+		if q1 < org && f.Bytes()[q1] == '\n' {
+			// The line's newline was left behind by the reversed search
+			q1++
+		}
 		//fmt.Printf("Line.Set 2: %d:%d\n", q0, q1)
 		f.Select(q0, q1)
 	}
+	return nil
 }
 
-func (d Dot) Set(f Editor) {
+func (d Dot) Set(f Editor) error {
 	//f.Select(d.Q0, d.Q1)
+	return nil
 }
@@ -0,0 +1,272 @@
+package edit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/as/text"
+)
+
+// ApplyOptions controls how Apply edits files
+type ApplyOptions struct {
+	// Diff, if not nil, receives a unified diff of the changes
+	// made to each file
+	Diff io.Writer
+
+	// Context is the number of context lines in a diff, as for
+	// Options.Context
+	Context int
+
+	// DryRun leaves the files unchanged. The program runs as
+	// it does for Command.Diff: its writes are discarded and its
+	// commands aren't run.
+	DryRun bool
+
+	// Backup, if not empty, keeps the old contents of each
+	// changed file in the file's name followed by Backup
+	Backup string
+
+	// Sync flushes each changed file to disk before it
+	// replaces the old one
+	Sync bool
+
+	// Confirm, if not nil, is asked about each hunk of the
+	// changes to the named file, which is in ed, and only the
+	// hunks it accepts are made. If it returns ErrStop, the file
+	// keeps the hunks accepted so far and Apply stops. Any other
+	// error fails the file.
+	Confirm func(name string, ed Editor, h *Hunk) (bool, error)
+}
+
+// FileError is the reason Apply failed to edit a file
+type FileError struct {
+	Name string
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	return e.Name + ": " + e.Err.Error()
+}
+
+func (e *FileError) Unwrap() error { return e.Err }
+
+// Summary describes the files edited by Apply
+type Summary struct {
+	Files    int          // files the program ran on
+	Changed  int          // files the program changed
+	Skipped  int          // binary files skipped
+	Inserted int64        // bytes inserted in the changed files
+	Deleted  int64        // bytes deleted from the changed files
+	Errors   []*FileError // files that couldn't be edited
+}
+
+// Apply runs c on each file named by paths and writes back the
+// files it changes. A path may be a file, a directory, which is
+// walked, or a filepath.Match pattern. Files and directories found
+// by walking a directory or matching a pattern are skipped if a
+// .gitignore file excludes them, and binary files are always
+// skipped. Each file is edited in a new buffer and replaced
+// atomically, keeping its mode.
+//
+// The program is compiled again for each file with c's options
+// and the file's name as Options.Origin, so $%, = and relative
+// file names refer to the file being edited.
+//
+// A file that can't be edited doesn't stop the others. The
+// summary lists every failure, and the error is the first one.
+func Apply(c *Command, paths []string, opts *ApplyOptions) (*Summary, error) {
+	return ApplyContext(context.Background(), c, paths, opts)
+}
+
+// ApplyContext is like Apply, but stops and returns ctx.Err() if
+// ctx is done before every file is edited. The files edited
+// until then keep their changes.
+func ApplyContext(ctx context.Context, c *Command, paths []string, opts *ApplyOptions) (*Summary, error) {
+	a := &applier{
+		ctx:  ctx,
+		c:    c,
+		ign:  newIgnorer(),
+		seen: make(map[string]bool),
+		sum:  &Summary{},
+	}
+	if opts != nil {
+		a.ApplyOptions = *opts
+	}
+	for _, p := range paths {
+		if ctx.Err() != nil || a.stop {
+			break
+		}
+		a.path(p)
+	}
+	if err := ctx.Err(); err != nil {
+		return a.sum, err
+	}
+	if len(a.sum.Errors) != 0 {
+		return a.sum, a.sum.Errors[0]
+	}
+	return a.sum, nil
+}
+
+// applier is a running Apply
+type applier struct {
+	ApplyOptions
+	ctx  context.Context
+	c    *Command
+	ign  *ignorer
+	seen map[string]bool // files already edited
+	sum  *Summary
+	stop bool // Confirm returned ErrStop
+}
+
+func (a *applier) fail(name string, err error) {
+	a.sum.Errors = append(a.sum.Errors, &FileError{Name: name, Err: err})
+}
+
+// path edits the files named by p
+func (a *applier) path(p string) {
+	if !strings.ContainsAny(p, `*?[`) {
+		a.walk(p)
+		return
+	}
+	m, err := filepath.Glob(p)
+	if err == nil && len(m) == 0 {
+		err = errors.New("no matching files")
+	}
+	if err != nil {
+		a.fail(p, err)
+		return
+	}
+	for _, name := range m {
+		if a.stop {
+			return
+		}
+		if !a.ign.ignored(name, isDir(name)) {
+			a.walk(name)
+		}
+	}
+}
+
+// walk edits root and, if it's a directory, the files under it
+// that aren't ignored
+func (a *applier) walk(root string) {
+	err := filepath.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			a.fail(name, err)
+			return nil
+		}
+		if err := a.ctx.Err(); err != nil {
+			return err
+		}
+		if a.stop {
+			return ErrStop
+		}
+		if name != root && a.ign.ignored(name, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() || name == root && !d.IsDir() {
+			a.file(name)
+		}
+		return nil
+	})
+	if err != nil && err != a.ctx.Err() && err != ErrStop {
+		a.fail(root, err)
+	}
+}
+
+// file runs the program on the named file and writes it back
+// if it changed
+func (a *applier) file(name string) {
+	if a.seen[name] {
+		return
+	}
+	a.seen[name] = true
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		a.fail(name, err)
+		return
+	}
+	if binary(data) {
+		a.sum.Skipped++
+		return
+	}
+	a.sum.Files++
+	c, err := a.compile(name)
+	if err != nil {
+		a.fail(name, err)
+		return
+	}
+	ed, err := text.Open(text.BufferFrom(append([]byte{}, data...)))
+	if err != nil {
+		a.fail(name, err)
+		return
+	}
+	if a.Confirm != nil {
+		err = c.ConfirmContext(a.ctx, ed, func(h *Hunk) (bool, error) {
+			return a.Confirm(name, ed, h)
+		})
+		if err == ErrStop {
+			a.stop, err = true, nil
+		}
+	} else {
+		err = c.RunContext(a.ctx, ed)
+	}
+	if err != nil {
+		a.fail(name, err)
+		return
+	}
+	p := ed.Bytes()
+	if bytes.Equal(p, data) {
+		return
+	}
+	a.sum.Changed++
+	a.sum.Inserted += c.ins
+	a.sum.Deleted += c.del
+	if a.Diff != nil {
+		unified(a.Diff, name, data, p, contextLines(a.Context))
+	}
+	if a.DryRun {
+		return
+	}
+	if err = (osFS{backup: a.Backup, sync: a.Sync}).WriteFile(name, p); err != nil {
+		a.fail(name, err)
+	}
+}
+
+// compile returns the program compiled for the named file
+func (a *applier) compile(name string) (*Command, error) {
+	var o Options
+	if a.c.opts != nil {
+		o = *a.c.opts
+	}
+	o.Origin = name
+	c, err := Compile(a.c.prog, &o)
+	if err != nil {
+		return nil, err
+	}
+	c.dry = a.DryRun
+	return c, nil
+}
+
+// binary reports whether data looks like the contents of a
+// binary file: one with a NUL byte near the start
+func binary(data []byte) bool {
+	if len(data) > 8000 {
+		data = data[:8000]
+	}
+	return bytes.IndexByte(data, 0) >= 0
+}
+
+func isDir(name string) bool {
+	fi, err := os.Stat(name)
+	return err == nil && fi.IsDir()
+}
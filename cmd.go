@@ -1,13 +1,13 @@
 package edit
 
 import (
-	"bytes"
+	"context"
+	"fmt"
 	"io"
-	"io/ioutil"
-	"os"
-	"os/exec"
+	"io/fs"
 	"regexp"
 	"strings"
+	"unicode/utf8"
 )
 
 type (
@@ -17,8 +17,11 @@ type (
 	Change    struct{ To []byte }
 	ReadFile  struct{ Name string }
 	WriteFile struct{ Name string }
+	Edit      struct{ Name string }
 	Pipe      struct{ To string }
+	Input     struct{ From string }
 	Trade     struct{ Address }
+	Block     []func(Editor) error
 	S         struct {
 		*regexp.Regexp
 		ReplaceAmp
@@ -27,20 +30,48 @@ type (
 	}
 )
 
-func (c Append) Apply(ed Editor) {
+// Shell runs a command without changing the text. The
+// command's output is sent to Sender.
+type Shell struct {
+	Cmd    string
+	Sender Sender
+}
+
+// Apply runs each command in the block with dot set to the
+// value it had on entry. Because the commands run against a
+// recording of the original text, their changes don't affect
+// each other's addresses.
+func (b Block) Apply(ed Editor) error {
+	q0, q1 := ed.Dot()
+	for _, fn := range b {
+		if fn == nil {
+			continue
+		}
+		ed.Select(q0, q1)
+		if err := fn(ed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c Append) Apply(ed Editor) error {
 	_, q1 := ed.Dot()
 	ed.Insert(c.Data, q1)
+	return nil
 }
-func (c Insert) Apply(ed Editor) {
+func (c Insert) Apply(ed Editor) error {
 	q0, _ := ed.Dot()
 	ed.Insert(c.Data, q0)
+	return nil
 }
 
-func (c Delete) Apply(ed Editor) {
+func (c Delete) Apply(ed Editor) error {
 	ed.Delete(ed.Dot())
+	return nil
 }
 
-func (c Change) Apply(ed Editor) {
+func (c Change) Apply(ed Editor) error {
 	q0, q1 := ed.Dot()
 	del := q1 - q0
 	ins := int64(len(c.To))
@@ -55,78 +86,134 @@ func (c Change) Apply(ed Editor) {
 	} else {
 		ed.(io.WriterAt).WriteAt(c.To, q0)
 	}
+	return nil
 }
 
-func (c ReadFile) Apply(ed Editor) {
-	data, err := ioutil.ReadFile(c.Name)
+func (c ReadFile) Apply(ed Editor) error {
+	data, err := fs.ReadFile(fsOf(ed), c.Name)
 	if err != nil {
-		eprint(err)
-		return
+		return err
 	}
 	q0, q1 := ed.Dot()
 	if q0 != q1 {
 		ed.Delete(q0, q1)
 	}
 	ed.Insert(data, q0)
+	return nil
 }
 
-func (c WriteFile) Apply(ed Editor) {
-	fd, err := os.Create(c.Name)
+// Apply writes dot to the named file
+func (c WriteFile) Apply(ed Editor) error {
+	q0, q1 := ed.Dot()
+	return fsOf(ed).WriteFile(c.Name, ed.Bytes()[q0:q1])
+}
+
+// Apply replaces the contents of ed with the named file
+func (c Edit) Apply(ed Editor) error {
+	ed.Select(0, ed.Len())
+	return ReadFile{Name: c.Name}.Apply(ed)
+}
+
+func (c Pipe) Apply(ed Editor) error {
+	q0, q1 := ed.Dot()
+	out, err := command(ed, c.To, append([]byte{}, ed.Bytes()[q0:q1]...))
 	if err != nil {
-		eprint(err)
-		return
+		return err
 	}
-	defer fd.Close()
-	q0, q1 := ed.Dot()
-	_, err = io.Copy(fd, bytes.NewReader(ed.Bytes()[q0:q1]))
+	return Change{To: out}.Apply(ed)
+}
+
+// Apply replaces dot with the output of the command. The
+// command's standard input is empty.
+func (c Input) Apply(ed Editor) error {
+	out, err := command(ed, c.From, nil)
 	if err != nil {
-		eprint(err)
+		return err
 	}
+	return Change{To: out}.Apply(ed)
 }
 
-func (c Pipe) Apply(ed Editor) {
-	x := strings.Fields(c.To)
-	if len(x) == 0 || x[0] == "" {
-		eprint("|: nothing on rhs")
+// Apply runs the command without touching ed. The command's
+// standard input is empty and its output is sent to c.Sender.
+func (c Shell) Apply(ed Editor) error {
+	out, err := command(ed, c.Cmd, nil)
+	if c.Sender != nil && len(out) > 0 {
+		c.Sender.Send(Print(out))
 	}
-	n := x[0]
-	var a []string
-	if len(x) > 1 {
-		a = x[1:]
+	return err
+}
+
+// command runs the command line s with stdin as its standard
+// input and returns its standard output. The error is non-nil
+// if the command can't be run or exits with a non-zero status.
+// The command is killed if the run using ed is cancelled or the
+// command runs out of time.
+func command(ed Editor, s string, stdin []byte) ([]byte, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, fmt.Errorf("nothing on rhs")
 	}
-	q0, q1 := ed.Dot()
-	cmd := exec.Command(n, a...)
-	cmd.Stdin = bytes.NewReader(append([]byte{}, ed.Bytes()[q0:q1]...))
-	buf := new(bytes.Buffer)
-	cmd.Stdout = buf
-	err := cmd.Run()
-	if err != nil {
-		eprint(err)
+	ctx, max := contextOf(ed), limitsOf(ed).Runtime
+	if max > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, max)
+		defer cancel()
+	}
+	out, err := execOf(ed).Exec(ctx, s, stdin)
+	if err != nil && ctx.Err() == context.DeadlineExceeded && contextOf(ed).Err() == nil {
+		err = fmt.Errorf("%s: %w", s, &LimitError{Limit: "Runtime", Max: int64(max)})
 	}
-	Change{To: buf.Bytes()}.Apply(ed)
+	return out, err
 }
-func (c S) Apply(ed Editor) {
+
+// Apply replaces the c.Limit'th match of the regexp in dot, or
+// every match if c.Limit is -1. An empty match adjacent to the
+// previous match is skipped.
+func (c S) Apply(ed Editor) error {
 	sp, ep := ed.Dot()
-	buf := bytes.NewReader(ed.Bytes()[sp:ep])
-	q0 := int64(0)
-	for i := int64(1); q0+sp != ep; i++ {
-		loc := c.FindReaderIndex(buf)
-		if loc == nil {
+	p := ed.Bytes()[sp:ep]
+	q0, last := 0, -1
+	ctx, lim := contextOf(ed), limitsOf(ed)
+	n := int64(0)
+	for i := int64(1); q0 <= len(p); {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		m := c.FindSubmatchIndex(p[q0:])
+		if m == nil {
 			break
 		}
-		q1 := q0 + int64(loc[1])
-		q0 += int64(loc[0])
-		ed.Select(sp+q0, sp+q1)
-
+		for j := range m {
+			if m[j] >= 0 {
+				m[j] += q0
+			}
+		}
+		q0 = m[1]
+		if m[0] == m[1] {
+			// Step over a whole rune, so the next match
+			// can't start inside it
+			_, w := utf8.DecodeRune(p[q0:])
+			q0 += w
+			if w == 0 {
+				q0++
+			}
+			if m[0] == last {
+				continue
+			}
+		}
+		last = m[1]
 		if i == c.Limit || c.Limit == -1 {
-			buf := c.ReplaceAmp.Gen(ed.Bytes()[q0:q1])
-			Change{buf}.Apply(ed)
-			if i == 500000 {
-				break
+			n++
+			if err := lim.match(n); err != nil {
+				return err
+			}
+			ed.Select(sp+int64(m[0]), sp+int64(m[1]))
+			nextMatch(ed)
+			if err := (Change{c.ReplaceAmp.Expand(p, m)}).Apply(ed); err != nil {
+				return err
 			}
 		}
-		q0 = q1
-		buf.Seek(q0, 0)
+		i++
 	}
 	ed.Select(ep, ep)
+	return nil
 }
@@ -0,0 +1,197 @@
+// Apply runs an edit program on files in place, for changes that
+// span many files or whole repositories.
+//
+// Usage:
+//
+//	apply [-diff] [-i] [-backup suffix] [-e program]... [-f file]... path...
+//	apply [-diff] [-i] [-backup suffix] program path...
+//
+// The program is made of the -e arguments and the contents of the
+// -f files, in order, each on its own line. Without either flag,
+// the first argument is the program. Each line of the program
+// runs on the text left by the lines before it, and $%, = and
+// relative file names refer to the file being edited. A path may be a file, a
+// directory, which is walked, or a pattern. Binary files are
+// skipped, as are the files found in directories or by patterns
+// that .gitignore files exclude.
+//
+// Each changed file is replaced atomically. With -diff, the
+// changes are written to standard output as a unified diff and
+// the files are left unchanged: the program's w and > write
+// nothing, and its |, < and ! fail. With -backup, the old contents of
+// each changed file are kept in the file's name followed by the
+// suffix.
+//
+// With -i, each hunk of the changes, the changes made by a command
+// for one match, is shown on standard error with the lines it
+// changes, and apply asks whether to make it. The answer is read
+// from standard input:
+//
+//	y	make the change
+//	n	skip the change
+//	a	make this change and the rest in the file
+//	d	skip this change and the rest in the file
+//	q	skip this change and stop; the changes made so far are kept
+//
+// Files that can't be edited are reported on standard error and
+// don't stop the others. A summary follows unless -q is given.
+//
+// The exit status is 1 if any file can't be edited, 2 for bad
+// usage, and 3 if the program doesn't compile.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/as/edit"
+	"github.com/as/edit/internal/cli"
+)
+
+const (
+	exitRun     = 1 // a file couldn't be edited
+	exitUsage   = 2 // bad flags or arguments
+	exitCompile = 3 // the program doesn't compile
+)
+
+// confirmer asks about each hunk of the changes, like git add -p
+type confirmer struct {
+	in   *bufio.Reader
+	out  io.Writer
+	file string // the file being asked about
+	rest byte   // the answer to the rest of its hunks, if any
+}
+
+const help = `y - make this change
+n - skip this change
+a - make this change and the rest in the file
+d - skip this change and the rest in the file
+q - skip this change and stop
+`
+
+func (c *confirmer) confirm(name string, ed edit.Editor, h *edit.Hunk) (bool, error) {
+	if name != c.file {
+		c.file, c.rest = name, 0
+	}
+	if c.rest != 0 {
+		return c.rest == 'y', nil
+	}
+	show(c.out, name, ed.Bytes(), h)
+	for {
+		fmt.Fprintf(c.out, "make this change [y,n,a,d,q,?]? ")
+		ans, err := c.in.ReadString('\n')
+		if ans == "" && err != nil {
+			ans = "q"
+		}
+		switch strings.TrimSpace(ans) {
+		case "y":
+			return true, nil
+		case "n":
+			return false, nil
+		case "a":
+			c.rest = 'y'
+			return true, nil
+		case "d":
+			c.rest = 'n'
+			return false, nil
+		case "q":
+			return false, edit.ErrStop
+		default:
+			fmt.Fprint(c.out, help)
+		}
+	}
+}
+
+// show writes the lines of src that h changes, as they are
+// before and after the change
+func show(w io.Writer, name string, src []byte, h *edit.Hunk) {
+	q0 := int64(bytes.LastIndexByte(src[:h.Q0], '\n') + 1)
+	q1 := int64(len(src))
+	if i := bytes.IndexByte(src[h.Q1:], '\n'); i >= 0 {
+		q1 = h.Q1 + int64(i)
+	}
+	line := bytes.Count(src[:q0], []byte("\n")) + 1
+	fmt.Fprintf(w, "%s:%d: %s\n", name, line, h.Cmd)
+	after := append(append(append([]byte{}, src[q0:h.Q0]...), h.New...), src[h.Q1:q1]...)
+	lines(w, "-", src[q0:q1])
+	lines(w, "+", after)
+}
+
+// lines writes each line of p after prefix
+func lines(w io.Writer, prefix string, p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	for _, ln := range bytes.Split(p, []byte("\n")) {
+		fmt.Fprintf(w, "%s%s\n", prefix, ln)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: apply [-diff] [-i] [-backup suffix] [-e program]... [-f file]... path...\n")
+	fmt.Fprintf(os.Stderr, "       apply [-diff] [-i] [-backup suffix] program path...\n")
+	flag.PrintDefaults()
+	os.Exit(exitUsage)
+}
+
+func main() {
+	var prog cli.Program
+	flag.Var(prog.Expr(), "e", "add the `program` text")
+	flag.Var(prog.Script(), "f", "add the program in `file`")
+	diff := flag.Bool("diff", false, "write a diff of the changes instead of making them")
+	backup := flag.String("backup", "", "keep the old contents of changed files in name`suffix`")
+	quiet := flag.Bool("q", false, "don't print the summary")
+	interactive := flag.Bool("i", false, "ask before making each change")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(prog) == 0 && len(args) != 0 {
+		prog, args = cli.Program{args[0]}, args[1:]
+	}
+	if len(args) == 0 {
+		usage()
+	}
+	cmd, err := edit.Compile(prog.String(), &edit.Options{PerLine: true})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "apply: %s\n", err)
+		os.Exit(exitCompile)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	opts := &edit.ApplyOptions{Backup: *backup}
+	if *diff {
+		opts.Diff, opts.DryRun = out, true
+	}
+	if *interactive {
+		c := &confirmer{in: bufio.NewReader(os.Stdin), out: os.Stderr}
+		opts.Confirm = c.confirm
+	}
+	sum, err := edit.Apply(cmd, args, opts)
+	out.Flush()
+	for _, err := range sum.Errors {
+		fmt.Fprintf(os.Stderr, "apply: %s\n", err)
+	}
+	if !*quiet {
+		verb := "changed"
+		if *diff {
+			verb = "would change"
+		}
+		fmt.Fprintf(os.Stderr, "apply: %d of %d files %s, +%d -%d bytes", sum.Changed, sum.Files, verb, sum.Inserted, sum.Deleted)
+		if sum.Skipped != 0 {
+			fmt.Fprintf(os.Stderr, ", %d binary skipped", sum.Skipped)
+		}
+		if len(sum.Errors) != 0 {
+			fmt.Fprintf(os.Stderr, ", %d failed", len(sum.Errors))
+		}
+		fmt.Fprintln(os.Stderr)
+	}
+	if err != nil {
+		os.Exit(exitRun)
+	}
+}
@@ -0,0 +1,166 @@
+// Sam is an interactive, line-oriented editor for the edit command
+// language, like sam -d. It needs nothing but a terminal, so it
+// works over a plain ssh connection.
+//
+// Usage:
+//
+//	sam [-prompt string] [file...]
+//
+// The files are loaded, and the first one is current. Each line
+// read is a program run on the current file, and dot is kept
+// from one line to the next. The text of a, i and c, and the
+// commands in braces, continue on the lines that follow. Besides
+// the commands of the language, which include sam's file commands,
+// u to undo and w to write, sam understands:
+//
+//	q	quit, unless a file is modified; a second q quits anyway
+//	Q	quit
+//
+// The output of p, = and ! is printed as the commands run. Errors
+// are printed as a question mark followed by the reason.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/as/edit"
+	"github.com/as/edit/internal/cli"
+	"github.com/as/text"
+)
+
+// session is an interactive session on a workspace
+type session struct {
+	ws     *edit.Workspace
+	in     *bufio.Scanner
+	out    *bufio.Writer
+	prompt string
+}
+
+func main() {
+	prompt := flag.String("prompt", "", "print `string` before reading each command")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: sam [-prompt string] [file...]\n")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	flag.Parse()
+
+	out := bufio.NewWriter(os.Stdout)
+	s := &session{
+		ws:     edit.NewWorkspace(&edit.Options{Sender: cli.Printer{W: out}}),
+		in:     bufio.NewScanner(os.Stdin),
+		out:    out,
+		prompt: *prompt,
+	}
+	for _, name := range flag.Args() {
+		if err := s.load(name); err != nil {
+			fmt.Fprintf(os.Stderr, "sam: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if flag.NArg() != 0 {
+		s.ws.Select(flag.Arg(0))
+	}
+	s.loop()
+	out.Flush()
+}
+
+// load adds the named file to the workspace. A file that doesn't
+// exist starts out empty.
+func (s *session) load(name string) error {
+	data, err := ioutil.ReadFile(name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	ed, err := text.Open(text.BufferFrom(data))
+	if err != nil {
+		return err
+	}
+	f := s.ws.Add(name, ed)
+	f.Undo = edit.NewUndo(ed)
+	return nil
+}
+
+// loop runs the commands read until q, Q or the end of the input
+func (s *session) loop() {
+	warned := false
+	for {
+		if s.prompt != "" {
+			s.out.WriteString(s.prompt)
+		}
+		s.out.Flush()
+		if !s.in.Scan() {
+			return
+		}
+		line := s.in.Text()
+		switch strings.TrimSpace(line) {
+		case "":
+			continue
+		case "Q":
+			return
+		case "q":
+			if s.modified() && !warned {
+				s.report(errors.New("changed files"))
+				warned = true
+				continue
+			}
+			return
+		}
+		warned = false
+		prog := line
+		for incomplete(prog) && s.in.Scan() {
+			prog += "\n" + s.in.Text()
+		}
+		if err := s.ws.Run(prog); err != nil {
+			s.report(err)
+		}
+		for _, f := range s.ws.Files() {
+			if f.Undo == nil {
+				f.Undo = edit.NewUndo(f.Editor)
+			}
+		}
+	}
+}
+
+// modified reports whether a file has unsaved changes
+func (s *session) modified() bool {
+	for _, f := range s.ws.Files() {
+		if f.Modified {
+			return true
+		}
+	}
+	return false
+}
+
+// report prints a short description of err
+func (s *session) report(err error) {
+	var se *edit.SyntaxError
+	var e *edit.Error
+	msg := err.Error()
+	switch {
+	case errors.As(err, &se):
+		msg = se.Msg
+	case errors.As(err, &e) && e.Cmd != "":
+		msg = e.Cmd + ": " + e.Err.Error()
+	case errors.As(err, &e):
+		msg = e.Err.Error()
+	}
+	fmt.Fprintf(s.out, "?%s\n", msg)
+}
+
+// incomplete reports whether prog needs more lines: the text of
+// an a, i or c command or a block that hasn't ended
+func incomplete(prog string) bool {
+	_, err := edit.Compile(prog + "\n")
+	var se *edit.SyntaxError
+	if !errors.As(err, &se) {
+		return false
+	}
+	return se.Msg == `missing terminating line "."` || se.Msg == "missing }"
+}
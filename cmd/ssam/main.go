@@ -0,0 +1,129 @@
+// Ssam runs an edit program on its input and writes the result to
+// standard output, like sam's ssam script.
+//
+// Usage:
+//
+//	ssam [-n] [-e program]... [-f file]... [file...]
+//	ssam [-n] program [file...]
+//
+// The program is made of the -e arguments and the contents of the
+// -f files, in order, each on its own line. Without either flag,
+// the first argument is the program. Like sam, each line of the
+// program runs on the text left by the lines before it. The input is the named
+// files, concatenated, or standard input if there are none. If
+// there is exactly one file, its name is the one = reports.
+//
+// The output of p, = and ! is written to standard output as
+// the program runs, each message on its own line. Unless -n is
+// given, the edited text is written after it.
+//
+// The exit status is 1 if the program fails while running, 2 for
+// bad usage, and 3 if the program doesn't compile.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/as/edit"
+	"github.com/as/edit/internal/cli"
+	"github.com/as/text"
+)
+
+const (
+	exitRun     = 1 // the program failed while running
+	exitUsage   = 2 // bad flags or arguments
+	exitCompile = 3 // the program doesn't compile
+)
+
+// usage writes the usage message of fs to w
+func usage(w io.Writer, fs *flag.FlagSet) {
+	fmt.Fprintf(w, "usage: ssam [-n] [-e program]... [-f file]... [file...]\n")
+	fmt.Fprintf(w, "       ssam [-n] program [file...]\n")
+	fs.PrintDefaults()
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run runs ssam with the arguments args and returns its exit
+// status
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("ssam", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var prog cli.Program
+	fs.Var(prog.Expr(), "e", "add the `program` text")
+	fs.Var(prog.Script(), "f", "add the program in `file`")
+	quiet := fs.Bool("n", false, "don't write the edited text")
+	fs.Usage = func() { usage(stderr, fs) }
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	fatal := func(code int, err error) int {
+		fmt.Fprintf(stderr, "ssam: %s\n", err)
+		return code
+	}
+
+	args = fs.Args()
+	if len(prog) == 0 {
+		if len(args) == 0 {
+			fs.Usage()
+			return exitUsage
+		}
+		prog, args = cli.Program{args[0]}, args[1:]
+	}
+
+	out := bufio.NewWriter(stdout)
+	defer out.Flush()
+	opts := &edit.Options{Sender: cli.Printer{W: out}, PerLine: true}
+	if len(args) == 1 {
+		opts.Origin = args[0]
+	}
+	cmd, err := edit.Compile(prog.String(), opts)
+	if err != nil {
+		return fatal(exitCompile, err)
+	}
+
+	data, err := readInput(args, stdin)
+	if err != nil {
+		return fatal(exitRun, err)
+	}
+	ed, err := text.Open(text.BufferFrom(data))
+	if err != nil {
+		return fatal(exitRun, err)
+	}
+	if err = cmd.Run(ed); err != nil {
+		out.Flush()
+		return fatal(exitRun, err)
+	}
+	if !*quiet {
+		out.Write(ed.Bytes())
+	}
+	if err = out.Flush(); err != nil {
+		return fatal(exitRun, err)
+	}
+	return 0
+}
+
+// readInput returns the contents of the named files, or of
+// stdin if there are none
+func readInput(names []string, stdin io.Reader) ([]byte, error) {
+	if len(names) == 0 {
+		return ioutil.ReadAll(stdin)
+	}
+	var r []io.Reader
+	for _, name := range names {
+		fd, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer fd.Close()
+		r = append(r, fd)
+	}
+	return ioutil.ReadAll(io.MultiReader(r...))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "script")
+	if err := ioutil.WriteFile(script, []byte(",x/a/ c/b/\n,x/b/ c/c/\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("a b\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range []struct {
+		args   []string
+		in     string
+		want   string
+		status int
+	}{
+		{[]string{",x/a/ c/b/"}, "aa", "bb", 0},
+		{[]string{"-e", ",x/a/ c/b/", "-e", ",x/b/ c/c/"}, "ab", "cc", 0},
+		{[]string{"-f", script}, "ab", "cc", 0},
+		{[]string{"-e", ",x/a/ c/b/", "-f", script}, "a", "c", 0},
+		{[]string{"-n", ",x/a/ p"}, "aba", "a\na\n", 0},
+		{[]string{"-n", "-e", ",c/x/", "-e", ", p"}, "ab", "x\n", 0},
+		{[]string{",x/b/ c/z/", file}, "", "a z\n", 0},
+		{[]string{",x/a/ c/z/", filepath.Join(dir, "missing")}, "", "", exitRun},
+		{[]string{"/nothing/ d"}, "text", "", exitRun},
+		{[]string{",x/(/ d"}, "", "", exitCompile},
+		{[]string{"-f", filepath.Join(dir, "missing")}, "", "", exitUsage},
+		{nil, "", "", exitUsage},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			status := run(v.args, strings.NewReader(v.in), &stdout, &stderr)
+			if status != v.status {
+				t.Fatalf("status: have %d, want %d: %s", status, v.status, stderr.String())
+			}
+			if status != 0 {
+				if stderr.Len() == 0 {
+					t.Fatalf("no error message")
+				}
+				return
+			}
+			if s := stdout.String(); s != v.want {
+				t.Fatalf("have: %q\nwant: %q\n", s, v.want)
+			}
+		})
+	}
+}
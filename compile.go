@@ -1,9 +1,12 @@
 package edit
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"sort"
 
 	"github.com/as/event"
 	"github.com/as/text"
@@ -16,21 +19,72 @@ var (
 )
 
 var (
-	noop = func(ed Editor) {}
+	noop = func(ed Editor) error { return nil }
 )
 
 type Options struct {
 	Sender Sender
 	Origin string
+
+	// PerLine runs each line of the program as its own
+	// transaction, so a line sees the changes made by the
+	// lines before it. A failing line leaves the changes of
+	// the earlier lines in place.
+	PerLine bool
+
+	// Context is the number of context lines around each
+	// change in a diff: DefaultContext if zero, none if
+	// negative.
+	Context int
+
+	// Limits bounds the work done by each run
+	Limits Limits
+
+	// Sandbox, if not nil, restricts the commands that use
+	// files and run programs
+	Sandbox *Sandbox
+
+	// FS, if not nil, is the file system used by e, r, w
+	// and > instead of the operating system's
+	FS FS
+
+	// Backup keeps the old contents of a file replaced by w
+	// or > in the file's name followed by "~". Sync flushes
+	// the new file to disk before it replaces the old one.
+	// Neither applies if FS is set.
+	Backup, Sync bool
+
+	// Exec, if not nil, runs the command lines of |, < and !
+	// instead of a ShellExecutor
+	Exec Executor
 }
 
 type Command struct {
-	fn       func(Editor)
+	fn       func(Editor) error
+	prog     string // the program compiled
 	s        string
 	args     string
 	next     *Command
 	Emit     *Emitted
 	modified bool
+	ins, del int64 // bytes inserted and deleted by the last run
+
+	marks *Marks // marks of the editor being run on
+	own   Marks  // marks for editors that aren't Markers
+
+	pos  int      // byte offset in the program
+	errs *errlist // errors from the current run
+
+	lines   []func(Editor) error // the program, line by line
+	perLine bool
+	undo    *undoer
+	opts    *Options
+	owners  *owners
+	budget  *budget
+
+	cmds map[int]*Command // the commands by position
+	ws   *wsRun           // the workspace run, if any
+	dry  bool             // a dry run: discard writes and run no commands
 }
 
 func MustCompile(s string) (cmd *Command) {
@@ -43,13 +97,43 @@ func MustCompile(s string) (cmd *Command) {
 
 // Compile runs the build steps on the input string and returns
 // a runnable command.
+//
+// If the program is malformed, the error is a *SyntaxError.
 func Compile(s string, opts ...*Options) (cmd *Command, err error) {
 	_, itemc := lex("cmd", s)
-	p := parse(itemc, opts...)
+	p := parse(s, itemc, opts...)
 	err = <-p.stop
+	go func() {
+		// the parser may stop early, unblock the lexer
+		for range itemc {
+		}
+	}()
 	return compile(p), err
 }
 
+// CompileReader compiles the program read from r
+func CompileReader(r io.Reader, opts ...*Options) (cmd *Command, err error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return Compile(string(data), opts...)
+}
+
+// CompileFile compiles the program in the named file. The
+// program may span multiple lines and contain comments.
+func CompileFile(name string, opts ...*Options) (cmd *Command, err error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	cmd, err = Compile(string(data), opts...)
+	if err, ok := err.(*SyntaxError); ok {
+		err.Name = name
+	}
+	return cmd, err
+}
+
 // Modified returns true if the last call to c.Run() modified the contents
 // of the editor
 func (c *Command) Modified() bool {
@@ -57,10 +141,19 @@ func (c *Command) Modified() bool {
 }
 
 // Func returns a function entry point that operates on a Editor
-func (c *Command) Func() func(Editor) {
-	return c.fn
+func (c *Command) Func() func(Editor) error {
+	return c.exec
 }
 
+// exec runs the program on ed and returns the errors from
+// every command that failed
+func (c *Command) exec(ed Editor) error {
+	c.errs.reset()
+	return c.errs.result(c.fn(ed))
+}
+
+// net returns the number of bytes inserted and deleted by the
+// changes in hist. A write counts as both.
 func net(hist worm.Logger) (ins, del int64) {
 	for i := int64(0); i < hist.Len(); i++ {
 		t, _ := hist.ReadAt(int64(i))
@@ -69,6 +162,9 @@ func net(hist worm.Logger) (ins, del int64) {
 			ins += t.Q1 - t.Q0
 		case *event.Delete:
 			del += t.Q1 - t.Q0
+		case *event.Write:
+			ins += int64(len(t.P))
+			del += int64(len(t.P))
 		}
 	}
 	return
@@ -90,35 +186,85 @@ func net(hist worm.Logger) (ins, del int64) {
 // 		i 2 Q	(not i 3 Q)
 // 		i 3 Q (not i 5 Q)
 //
+// The events are ordered by address before they are played
+// back, so commands in a block may record their changes in
+// any order. Inserts at the same address keep their relative
+// order and land before any other change made at that address.
+//
 // Commit will only reallocate ed's size once. If ed implements
 // io.WriterAt, a write-through fast path is used to commit the
-// transaction.
+// transaction. If ed implements Marker, its marks are moved to
+// follow the text around them. If two of the changes in
+// hist overlap, Commit returns a *ConflictError instead.
 func Commit(ed Editor, hist worm.Logger) (err error) {
+	if err = checkLog(hist, nil); err != nil {
+		return err
+	}
+	return commit(ed, hist, marksOf(ed, nil))
+}
+
+func commit(ed Editor, hist worm.Logger, marks Marks) (err error) {
 	//	log.Printf("commit: content: %q", ed.Bytes())
-	_, del := net(hist)
-	for i := int64(hist.Len()) - 1; i >= 0; i-- {
-		e, err := hist.ReadAt(i)
-		if err != nil {
-			return err
-		}
-		switch t := e.(type) {
+	ev, err := readEvents(hist)
+	if err != nil {
+		return err
+	}
+	for i := len(ev) - 1; i >= 0; i-- {
+		switch t := ev[i].(type) {
 		case *event.Write:
 			ed.(io.WriterAt).WriteAt(t.P, t.Q0)
 			//			log.Printf("event[%d]: %#v\n", i, e)
 		case *event.Insert:
-			ed.Insert(t.P, t.Q0+del)
+			ed.Insert(t.P, t.Q0)
+			marks.insert(t.Q0, int64(len(t.P)))
 			//			log.Printf("event[%d]: %#v\n", i, e)
 		case *event.Delete:
-			del -= int64(t.Q1 - t.Q0)
 			ed.Delete(t.Q0, t.Q1)
+			marks.delete(t.Q0, t.Q1)
 			//			log.Printf("event[%d]: %#v\n", i, e)
 		}
 	}
 	return err
 }
 
+// readEvents returns the events in hist sorted by address
+func readEvents(hist worm.Logger) (ev []interface{}, err error) {
+	ev = make([]interface{}, 0, hist.Len())
+	for i := int64(0); i < hist.Len(); i++ {
+		e, err := hist.ReadAt(i)
+		if err != nil {
+			return nil, err
+		}
+		ev = append(ev, e)
+	}
+	sort.SliceStable(ev, func(i, j int) bool {
+		qi, ki := order(ev[i])
+		qj, kj := order(ev[j])
+		if qi != qj {
+			return qi < qj
+		}
+		return ki < kj
+	})
+	return ev, nil
+}
+
+// order returns the sort key for event e: its starting
+// address and a rank that puts inserts first
+func order(e interface{}) (q0 int64, rank int) {
+	switch t := e.(type) {
+	case *event.Insert:
+		return t.Q0, 0
+	case *event.Write:
+		return t.Q0, 1
+	case *event.Delete:
+		return t.Q0, 2
+	}
+	return 0, 3
+}
+
 func (c *Command) ck(ed Editor) error {
 	c.modified = false
+	c.ins, c.del = 0, 0
 	if ed == nil {
 		return ErrNilEditor
 	}
@@ -128,26 +274,134 @@ func (c *Command) ck(ed Editor) error {
 	return nil
 }
 
-// Transcribe runs the compiled program on ed
+// Transcribe runs the compiled program on ed and returns a log of
+// the changes it would make. If any command fails, the error is an
+// Errors value describing each failure.
 func (c *Command) Transcribe(ed Editor) (log worm.Logger, err error) {
+	return c.TranscribeContext(context.Background(), ed)
+}
+
+// TranscribeContext is like Transcribe, but stops the program
+// and returns ctx.Err() if ctx is done before the program is.
+func (c *Command) TranscribeContext(ctx context.Context, ed Editor) (log worm.Logger, err error) {
 	if err = c.ck(ed); err != nil {
 		return nil, err
 	}
-	log = worm.NewLogger()
-	hist := text.NewHistory(&Recorder{ed}, log)
 	c.Emit.Dot = c.Emit.Dot[:0]
-	c.fn(hist)
-	return log, nil
+	c.budget.reset()
+	return c.record(ctx, ed, c.fn)
 }
 
-// Run runs the compiled program on ed
+// record runs fn on a recording of ed and returns the log of
+// the changes it would make. The log is checked for changes
+// that overlap. If fn fails, dot and the marks are restored, as
+// nothing will be committed.
+func (c *Command) record(ctx context.Context, ed Editor, fn func(Editor) error) (log worm.Logger, err error) {
+	log = worm.NewLogger()
+	*c.marks = marksOf(ed, c.own)
+	q0, q1 := ed.Dot()
+	marks := c.marks.clone()
+	defer func() {
+		if err != nil {
+			ed.Select(q0, q1)
+			c.marks.restore(marks)
+		}
+	}()
+	c.undo.n = 0
+	c.owners.reset()
+	c.errs.reset()
+	hist := text.NewHistory(&Recorder{ed}, &ownedLog{log, c.owners})
+	r := &runEditor{Editor: hist, ctx: ctx, lim: c.budget, ws: c.ws, own: c.owners}
+	if c.opts != nil {
+		r.fs, r.exec = c.opts.FS, c.opts.Exec
+		if r.fs == nil {
+			o := osFS{sync: c.opts.Sync}
+			if c.opts.Backup {
+				o.backup = "~"
+			}
+			r.fs = o
+		}
+	}
+	if c.dry {
+		r.fs, r.exec = dryFS{fsOf(r)}, ExecFunc(dryExec)
+	}
+	err = c.errs.result(fn(r))
+	if ctx.Err() != nil {
+		return log, ctx.Err()
+	}
+	if c.budget.err != nil {
+		return log, c.budget.err
+	}
+	if err != nil {
+		return log, err
+	}
+	return log, checkLog(log, c.owners)
+}
+
+// RunTransaction runs the compiled program on ed. If the program
+// fails, ed is left unchanged and the error is returned.
+//
+// If the program was compiled with Options.PerLine, each line
+// is a separate transaction.
 func (c *Command) RunTransaction(ed Editor) (err error) {
-	hist, err := c.Transcribe(ed)
+	return c.RunContext(context.Background(), ed)
+}
+
+// RunContext is like RunTransaction, but stops the program and
+// returns ctx.Err() if ctx is done before the program is. The
+// commands check ctx between matches, and subprocesses are
+// killed. The changes are only committed if the program ran to
+// completion, so a cancelled run leaves ed unchanged, with its
+// dot and marks as they were.
+func (c *Command) RunContext(ctx context.Context, ed Editor) (err error) {
+	if c.perLine {
+		return c.runLines(ctx, ed)
+	}
+	hist, err := c.TranscribeContext(ctx, ed)
 	if err != nil {
 		return err
 	}
 	c.modified = hist.Len() > 0
-	return Commit(ed, hist)
+	return c.commit(ed, hist)
+}
+
+// commit commits the transaction in log to ed. If the program
+// runs with an undo history, the transaction is recorded in it
+// and the undo asked for by the program's u commands follows.
+func (c *Command) commit(ed Editor, log worm.Logger) error {
+	ins, del := net(log)
+	c.ins, c.del = c.ins+ins, c.del+del
+	u := c.undo.Undo
+	if u == nil || u.ed != ed {
+		return commit(ed, log, marksOf(ed, c.own))
+	}
+	if err := u.commit(log, marksOf(ed, c.own)); err != nil {
+		return err
+	}
+	n := c.undo.n
+	c.undo.n = 0
+	c.modified = c.modified || n != 0
+	return u.Undo(n)
+}
+
+// runLines runs and commits each line of the program in turn
+func (c *Command) runLines(ctx context.Context, ed Editor) (err error) {
+	if err = c.ck(ed); err != nil {
+		return err
+	}
+	c.Emit.Dot = c.Emit.Dot[:0]
+	c.budget.reset()
+	for _, fn := range c.lines {
+		log, err := c.record(ctx, ed, fn)
+		if err != nil {
+			return err
+		}
+		c.modified = c.modified || log.Len() > 0
+		if err = c.commit(ed, log); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Run runs the compiled program on ed
@@ -160,8 +414,8 @@ func (c *Command) oldRun(ed Editor) (err error) {
 		return err
 	}
 	c.Emit.Dot = c.Emit.Dot[:0]
-	c.fn(ed)
-	return nil
+	*c.marks = marksOf(ed, c.own)
+	return c.exec(ed)
 }
 
 // Next returns the next instruction for the compiled program. This
@@ -170,14 +424,14 @@ func (c *Command) Next() *Command {
 	return c.next
 }
 
-func (c *Command) nextFn() func(f Editor) {
+func (c *Command) nextFn() func(f Editor) error {
 	if c.next == nil {
 		return nil
 	}
 	return c.next.fn
 }
 
-func compileAddr(a Address) func(f Editor) {
+func compileAddr(a Address) func(f Editor) error {
 	if a == nil {
 		return noop
 	}
@@ -185,20 +439,52 @@ func compileAddr(a Address) func(f Editor) {
 }
 
 func compile(p *parser) (cmd *Command) {
-	for i := range p.cmd {
-		if i+1 == len(p.cmd) {
+	lines := make([]func(Editor) error, len(p.lines))
+	for i, ln := range p.lines {
+		lines[i] = ln.compile()
+	}
+	fn := func(f Editor) error {
+		for _, fn := range lines {
+			if err := fn(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return &Command{
+		fn:      fn,
+		prog:    p.prog,
+		Emit:    p.Emit,
+		marks:   p.marks,
+		own:     *p.marks,
+		errs:    p.errs,
+		lines:   lines,
+		perLine: p.Options != nil && p.Options.PerLine,
+		undo:    p.undo,
+		opts:    p.Options,
+		owners:  p.owners,
+		budget:  p.budget,
+		cmds:    p.cmds,
+	}
+}
+
+// compile links the commands on the line and returns a function
+// that sets the address and runs the first one
+func (ln *line) compile() func(Editor) error {
+	for i := range ln.cmd {
+		if i+1 == len(ln.cmd) {
 			break
 		}
-		p.cmd[i].next = p.cmd[i+1]
+		ln.cmd[i].next = ln.cmd[i+1]
 	}
-	fn := func(f Editor) {
-		addr := compileAddr(p.addr)
-		if addr != nil {
-			addr(f)
+	addr := compileAddr(ln.addr)
+	return func(f Editor) error {
+		if err := addr(f); err != nil {
+			return &Error{Pos: ln.pos, Err: err}
 		}
-		if p.cmd != nil && p.cmd[0] != nil && p.cmd[0].fn != nil {
-			p.cmd[0].fn(f)
+		if ln.cmd != nil && ln.cmd[0] != nil && ln.cmd[0].fn != nil {
+			return ln.cmd[0].fn(f)
 		}
+		return nil
 	}
-	return &Command{fn: fn, Emit: p.Emit}
 }
@@ -0,0 +1,194 @@
+package edit
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"github.com/as/event"
+	"github.com/as/text"
+	"github.com/as/worm"
+)
+
+// ErrStop is returned by the accept function of Confirm to stop
+// asking. The hunks accepted so far are committed and the rest
+// are rejected.
+var ErrStop = errors.New("stop confirming")
+
+// Hunk is a group of changes a program would make: those made by
+// one command for one match of the loop running it. A command
+// that isn't run by a loop makes a single hunk.
+type Hunk struct {
+	Cmd string // the command's name, empty if unknown
+	Pos int    // byte offset of the command in the program
+	Dot        // the range of the original text the changes cover
+	Old []byte // the text in Dot before the changes
+	New []byte // the text in Dot after the changes
+
+	events []interface{}
+}
+
+// Confirm runs the compiled program on ed like RunTransaction,
+// but passes each hunk of its changes to accept, in the order
+// they appear in the text, and commits only the hunks it
+// accepts. If accept returns ErrStop, the hunks accepted so far
+// are committed, no more lines run, and Confirm returns ErrStop.
+// If it returns another error, the run stops there and the error
+// is returned.
+//
+// If the program was compiled with Options.PerLine, each line's
+// hunks are decided and committed before the next line runs, so
+// an error leaves the lines before it committed. Otherwise an
+// error other than ErrStop leaves ed unchanged.
+func (c *Command) Confirm(ed Editor, accept func(h *Hunk) (bool, error)) error {
+	return c.ConfirmContext(context.Background(), ed, accept)
+}
+
+// ConfirmContext is like Confirm, but stops the program and
+// returns ctx.Err() if ctx is done before the program is
+func (c *Command) ConfirmContext(ctx context.Context, ed Editor, accept func(h *Hunk) (bool, error)) error {
+	if err := c.ck(ed); err != nil {
+		return err
+	}
+	c.Emit.Dot = c.Emit.Dot[:0]
+	c.budget.reset()
+	lines := []func(Editor) error{c.fn}
+	if c.perLine {
+		lines = c.lines
+	}
+	for _, fn := range lines {
+		if err := c.confirm(ctx, ed, fn, accept); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// confirm runs fn on ed and commits the hunks of its changes
+// that accept accepts. Dot and the marks are restored if accept
+// fails with an error other than ErrStop.
+func (c *Command) confirm(ctx context.Context, ed Editor, fn func(Editor) error, accept func(h *Hunk) (bool, error)) error {
+	q0, q1 := ed.Dot()
+	marks := marksOf(ed, c.own).clone()
+	log, err := c.record(ctx, ed, fn)
+	if err != nil {
+		return err
+	}
+	hunks, err := c.hunks(ed, log)
+	if err != nil {
+		return err
+	}
+	keep := worm.NewLogger()
+	var stop error
+	for _, h := range hunks {
+		ok, err := accept(h)
+		if err == ErrStop {
+			stop = err
+			break
+		}
+		if err != nil {
+			ed.Select(q0, q1)
+			c.marks.restore(marks)
+			return err
+		}
+		if !ok {
+			continue
+		}
+		for _, e := range h.events {
+			keep.Write(e)
+		}
+	}
+	c.modified = c.modified || keep.Len() > 0
+	if err = c.commit(ed, keep); err != nil {
+		return err
+	}
+	return stop
+}
+
+// hunks groups the changes in log, made by running c on ed, by the
+// command and match that made them
+func (c *Command) hunks(ed Editor, log worm.Logger) ([]*Hunk, error) {
+	type key struct {
+		cmd   *Command
+		match int
+	}
+	var hunks []*Hunk
+	seen := make(map[key]*Hunk)
+	for i := int64(0); i < log.Len(); i++ {
+		e, err := log.ReadAt(i)
+		if err != nil {
+			return nil, err
+		}
+		var k key
+		if int(i) < len(c.owners.cmd) {
+			k = key{c.owners.cmd[i], c.owners.in[i]}
+		}
+		h := seen[k]
+		if h == nil {
+			h = &Hunk{Dot: Dot{-1, -1}}
+			if k.cmd != nil {
+				h.Cmd, h.Pos = k.cmd.s, k.cmd.pos
+			}
+			seen[k] = h
+			hunks = append(hunks, h)
+		}
+		h.events = append(h.events, e)
+		q0, q1 := extent(e)
+		if h.Q0 < 0 || q0 < h.Q0 {
+			h.Q0 = q0
+		}
+		if q1 > h.Q1 {
+			h.Q1 = q1
+		}
+	}
+	src := ed.Bytes()
+	for _, h := range hunks {
+		h.Old = append([]byte{}, src[h.Q0:h.Q1]...)
+		p, err := h.apply()
+		if err != nil {
+			return nil, err
+		}
+		h.New = p
+	}
+	sort.SliceStable(hunks, func(i, j int) bool {
+		return hunks[i].Q0 < hunks[j].Q0
+	})
+	return hunks, nil
+}
+
+// apply returns the text in h.Dot after h's changes
+func (h *Hunk) apply() ([]byte, error) {
+	ed, err := text.Open(text.BufferFrom(append([]byte{}, h.Old...)))
+	if err != nil {
+		return nil, err
+	}
+	log := worm.NewLogger()
+	for _, e := range h.events {
+		switch t := e.(type) {
+		case *event.Insert:
+			log.Write(&event.Insert{Q0: t.Q0 - h.Q0, Q1: t.Q1 - h.Q0, P: t.P})
+		case *event.Delete:
+			log.Write(&event.Delete{Q0: t.Q0 - h.Q0, Q1: t.Q1 - h.Q0, P: t.P})
+		case *event.Write:
+			log.Write(&event.Write{Q0: t.Q0 - h.Q0, Q1: t.Q1 - h.Q0, P: t.P})
+		}
+	}
+	if err = commit(ed, log, nil); err != nil {
+		return nil, err
+	}
+	return append([]byte{}, ed.Bytes()...), nil
+}
+
+// extent returns the range of the original text changed by the
+// event e
+func extent(e interface{}) (q0, q1 int64) {
+	switch t := e.(type) {
+	case *event.Insert:
+		return t.Q0, t.Q0
+	case *event.Write:
+		return t.Q0, t.Q0 + int64(len(t.P))
+	case *event.Delete:
+		return t.Q0, t.Q1
+	}
+	return 0, 0
+}
@@ -0,0 +1,109 @@
+package edit
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/as/event"
+	"github.com/as/worm"
+)
+
+// Overlap is one of two changes that overlap
+type Overlap struct {
+	Cmd string // the command's name, empty if unknown
+	Pos int    // byte offset of the command in the program
+	Dot        // the changed range in the original text
+}
+
+func (o Overlap) String() string {
+	if o.Cmd == "" {
+		return fmt.Sprintf("#%d,#%d", o.Q0, o.Q1)
+	}
+	return fmt.Sprintf("%d: %s #%d,#%d", o.Pos, o.Cmd, o.Q0, o.Q1)
+}
+
+// ConflictError is returned when a transaction changes the same
+// text twice, or inserts text inside a range it also changes.
+// Committing such a transaction would garble the text.
+type ConflictError struct {
+	A, B Overlap
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("changes not in sequence: %s and %s", e.A, e.B)
+}
+
+// owners tracks the commands that make the changes in a
+// transaction
+type owners struct {
+	cur   *Command   // the innermost command running
+	cmd   []*Command // cmd[i] made the i'th change
+	match int        // the match being edited, counted from zero
+	in    []int      // in[i] is the match the i'th change was made in
+}
+
+func (o *owners) reset() {
+	o.cur, o.cmd = nil, o.cmd[:0]
+	o.match, o.in = 0, o.in[:0]
+}
+
+// ownedLog is a log that records which command made each event,
+// and in which match
+type ownedLog struct {
+	worm.Logger
+	o *owners
+}
+
+func (l *ownedLog) Write(e interface{}) error {
+	l.o.cmd = append(l.o.cmd, l.o.cur)
+	l.o.in = append(l.o.in, l.o.match)
+	return l.Logger.Write(e)
+}
+
+// checkLog returns a *ConflictError if two of the changes in log
+// overlap. Inserts at the edges of another change are allowed. The
+// owners, if not nil, name the commands that made the changes.
+func checkLog(log worm.Logger, o *owners) error {
+	ch := make([]Overlap, 0, log.Len())
+	for i := int64(0); i < log.Len(); i++ {
+		e, err := log.ReadAt(i)
+		if err != nil {
+			return err
+		}
+		var c Overlap
+		switch t := e.(type) {
+		case *event.Insert:
+			c.Dot = Dot{t.Q0, t.Q0}
+		case *event.Write:
+			c.Dot = Dot{t.Q0, t.Q0 + int64(len(t.P))}
+		case *event.Delete:
+			c.Dot = Dot{t.Q0, t.Q1}
+		default:
+			continue
+		}
+		if o != nil && int(i) < len(o.cmd) && o.cmd[i] != nil {
+			c.Cmd, c.Pos = o.cmd[i].s, o.cmd[i].pos
+		}
+		ch = append(ch, c)
+	}
+	sort.SliceStable(ch, func(i, j int) bool {
+		return ch[i].Q0 < ch[j].Q0
+	})
+
+	// Sorted by start, a change can only overlap the
+	// change before it that reaches the furthest. An insert
+	// overlaps a change only if it falls strictly inside it.
+	last := -1
+	for i, c := range ch {
+		if last >= 0 {
+			p := ch[last]
+			if c.Q0 < p.Q1 && (c.Q0 < c.Q1 || p.Q0 < c.Q0) {
+				return &ConflictError{A: p, B: c}
+			}
+		}
+		if last < 0 || c.Q1 > ch[last].Q1 {
+			last = i
+		}
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package edit
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/as/text"
+)
+
+// DefaultContext is the number of context lines around each
+// change in a diff
+const DefaultContext = 3
+
+// Diff runs the program on a private copy of ed and returns the
+// changes it would make as a unified diff. The files are labeled
+// with Options.Origin. The diff is empty if nothing would change.
+// The editor is left untouched, but dot and the marks of the copy
+// are discarded with it.
+//
+// The program runs dry: w and > write nothing, and |, < and !
+// fail with ErrDryRun rather than run their commands.
+func (c *Command) Diff(ed Editor) ([]byte, error) {
+	if err := c.ck(ed); err != nil {
+		return nil, err
+	}
+	c.dry = true
+	defer func() { c.dry = false }()
+	old := ed.Bytes()
+	cp, err := text.Open(text.BufferFrom(append([]byte{}, old...)))
+	if err != nil {
+		return nil, err
+	}
+	cp.Select(ed.Dot())
+	s := &scratch{Editor: cp, marks: Marks{}}
+	for k, v := range marksOf(ed, c.own) {
+		s.marks[k] = v
+	}
+	if err = c.RunTransaction(s); err != nil {
+		return nil, err
+	}
+	var name string
+	ctx := contextLines(0)
+	if c.opts != nil {
+		name, ctx = c.opts.Origin, contextLines(c.opts.Context)
+	}
+	buf := new(bytes.Buffer)
+	unified(buf, name, old, cp.Bytes(), ctx)
+	return buf.Bytes(), nil
+}
+
+// contextLines returns the number of context lines asked for
+// by an Options.Context of n
+func contextLines(n int) int {
+	if n < 0 {
+		return 0
+	}
+	if n == 0 {
+		return DefaultContext
+	}
+	return n
+}
+
+// scratch is a private copy of an editor's text that keeps
+// its own copy of the editor's marks
+type scratch struct {
+	text.Editor
+	marks Marks
+}
+
+func (s *scratch) Marks() Marks { return s.marks }
+func (s *scratch) WriteAt(p []byte, at int64) (int, error) {
+	return s.Editor.(io.WriterAt).WriteAt(p, at)
+}
+
+// unified writes a unified diff of the lines in a and b to w,
+// with ctx lines of context around each change
+func unified(w io.Writer, name string, a, b []byte, ctx int) {
+	al, bl := splitLines(a), splitLines(b)
+	ops := diffLines(al, bl)
+
+	// ai[t] and bi[t] are the lines of a and b before ops[t]
+	ai := make([]int, len(ops)+1)
+	bi := make([]int, len(ops)+1)
+	for t, op := range ops {
+		ai[t+1], bi[t+1] = ai[t], bi[t]
+		if op != '+' {
+			ai[t+1]++
+		}
+		if op != '-' {
+			bi[t+1]++
+		}
+	}
+
+	header := false
+	for t := 0; t < len(ops); {
+		if ops[t] == ' ' {
+			t++
+			continue
+		}
+		// Extend the hunk until the next change is further
+		// than two contexts away
+		start := t - ctx
+		if start < 0 {
+			start = 0
+		}
+		end := t
+		for u := t; u < len(ops) && u <= end+2*ctx+1; u++ {
+			if ops[u] != ' ' {
+				end = u
+			}
+		}
+		stop := end + 1 + ctx
+		if stop > len(ops) {
+			stop = len(ops)
+		}
+		if !header {
+			fmt.Fprintf(w, "--- %s\n+++ %s\n", name, name)
+			header = true
+		}
+		fmt.Fprintf(w, "@@ -%s +%s @@\n", span(ai[start], ai[stop]), span(bi[start], bi[stop]))
+		for u := start; u < stop; u++ {
+			line := ""
+			switch ops[u] {
+			case '+':
+				line = bl[bi[u]]
+			default:
+				line = al[ai[u]]
+			}
+			fmt.Fprintf(w, "%c%s", ops[u], line)
+			if line[len(line)-1] != '\n' {
+				fmt.Fprint(w, "\n\\ No newline at end of file\n")
+			}
+		}
+		t = stop
+	}
+}
+
+// span formats the lines q0 up to q1 as a hunk range
+func span(q0, q1 int) string {
+	switch n := q1 - q0; n {
+	case 0:
+		return fmt.Sprintf("%d,0", q0)
+	case 1:
+		return fmt.Sprint(q0 + 1)
+	default:
+		return fmt.Sprintf("%d,%d", q0+1, n)
+	}
+}
+
+// splitLines splits p after each newline
+func splitLines(p []byte) (lines []string) {
+	for len(p) > 0 {
+		n := bytes.IndexByte(p, '\n') + 1
+		if n == 0 {
+			n = len(p)
+		}
+		lines = append(lines, string(p[:n]))
+		p = p[n:]
+	}
+	return lines
+}
+
+// diffLines returns the shortest edit script turning a into b:
+// a ' ' keeps a line, a '-' deletes one from a and a '+' inserts
+// one from b. It uses the linear space variant of Myers'
+// algorithm, which splits the problem at the middle of an optimal
+// path and solves each half in turn.
+func diffLines(a, b []string) (ops []byte) {
+	d := &differ{a: a, b: b, ops: make([]byte, 0, len(a)+len(b))}
+	d.compare(0, len(a), 0, len(b))
+	return d.ops
+}
+
+// differ holds the lines being compared and the script so far
+type differ struct {
+	a, b []string
+	ops  []byte
+}
+
+func (d *differ) emit(op byte, n int) {
+	for ; n > 0; n-- {
+		d.ops = append(d.ops, op)
+	}
+}
+
+// compare appends the script turning a[a0:a1] into b[b0:b1]
+func (d *differ) compare(a0, a1, b0, b1 int) {
+	// The common prefix and suffix are kept as is
+	pre := 0
+	for a0 < a1 && b0 < b1 && d.a[a0] == d.b[b0] {
+		a0, b0, pre = a0+1, b0+1, pre+1
+	}
+	suf := 0
+	for a0 < a1 && b0 < b1 && d.a[a1-1] == d.b[b1-1] {
+		a1, b1, suf = a1-1, b1-1, suf+1
+	}
+	d.emit(' ', pre)
+	switch {
+	case a0 == a1:
+		d.emit('+', b1-b0)
+	case b0 == b1:
+		d.emit('-', a1-a0)
+	default:
+		// Neither end matches, so the script has at least
+		// two edits and each half has fewer
+		if x, y, ok := d.middle(a0, a1, b0, b1); ok {
+			d.compare(a0, x, b0, y)
+			d.compare(x, a1, y, b1)
+		} else {
+			d.emit('-', a1-a0)
+			d.emit('+', b1-b0)
+		}
+	}
+	d.emit(' ', suf)
+}
+
+// middle returns a point on an optimal path from the start to
+// the end of a[a0:a1] and b[b0:b1], where the furthest reaching
+// paths from each end meet. The searches keep one diagonal
+// vector each, so it needs space linear in the number of lines.
+func (d *differ) middle(a0, a1, b0, b1 int) (x, y int, ok bool) {
+	a, b := d.a[a0:a1], d.b[b0:b1]
+	n, m := len(a), len(b)
+	max := (n + m + 1) / 2
+	off := max + 1
+	vf := make([]int, 2*off+1) // vf[off+k] is the furthest x on diagonal k from the start
+	vb := make([]int, 2*off+1) // vb[off+k] is the furthest x on diagonal k from the end
+	for i := range vf {
+		vf[i], vb[i] = -1, -1
+	}
+	vf[off+1], vb[off+1] = 0, 0
+	delta := n - m
+	odd := delta%2 != 0
+	for e := 0; e <= max; e++ {
+		for k := -e; k <= e; k += 2 {
+			x := vf[off+k-1] + 1
+			if k == -e || k != e && vf[off+k-1] < vf[off+k+1] {
+				x = vf[off+k+1]
+			}
+			y := x - k
+			if x > n || y > m || x < 0 || y < 0 {
+				continue
+			}
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			vf[off+k] = x
+			if kb := delta - k; odd && kb >= -e+1 && kb <= e-1 && vb[off+kb] >= 0 && x >= n-vb[off+kb] {
+				return a0 + x, b0 + y, true
+			}
+		}
+		for k := -e; k <= e; k += 2 {
+			x := vb[off+k-1] + 1
+			if k == -e || k != e && vb[off+k-1] < vb[off+k+1] {
+				x = vb[off+k+1]
+			}
+			y := x - k
+			if x > n || y > m || x < 0 || y < 0 {
+				continue
+			}
+			for x < n && y < m && a[n-1-x] == b[m-1-y] {
+				x, y = x+1, y+1
+			}
+			vb[off+k] = x
+			if kf := delta - k; !odd && kf >= -e && kf <= e && vf[off+kf] >= 0 && vf[off+kf] >= n-x {
+				xf := vf[off+kf]
+				return a0 + xf, b0 + xf - kf, true
+			}
+		}
+	}
+	return 0, 0, false
+}
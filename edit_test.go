@@ -1,8 +1,17 @@
 package edit
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"testing/fstest"
 	"time"
 
 	"github.com/as/text"
@@ -188,3 +197,1363 @@ Into two newlines.
 	}
 	close(done)
 }
+
+func TestBlock(t *testing.T) {
+	for i, v := range []tbl{
+		{"foo bar foo", `,x/foo/ { i/[/ a/]/ }`, "[foo] bar [foo]"},
+		{"foo bar foo", `,x/foo/ { a/]/ i/[/ }`, "[foo] bar [foo]"},
+		{"abcd", `#0,#2 { d a/x/ }`, "xcd"},
+		{"abcd", `#0,#2 { c/zz/ i/y/ }`, "yzzcd"},
+		{"ab ab", `,x/ab/ { x/a/ c/A/ x/b/ c/B/ }`, "AB AB"},
+		{"ab ab", `,x/ab/ { x/a/ { i/(/ a/)/ } x/b/d }`, "(a) (a)"},
+		{"ab cd", `,x/ab|cd/ { +#0 a/-/ i/+/ }`, "+ab- +cd-"},
+		{"ab cd", `,x/ab|cd/ { s/a|c/A/ s/b|d/B/g }`, "AB AB"},
+		{"a\nb\n", ",x/.*\\n/ {\n\ti/> /\n\ta/# /\n}", "> a\n# > b\n# "},
+		{"a1\nfoo x\nb1\nfoo y\nb2\nfoo z\nb3\n", `,x/foo.*\n/ { -1 d }`, "foo x\nfoo y\nfoo z\nb3\n"},
+		{"a1\nfoo x\nb1\nfoo y\nb2\nfoo z\nb3\n", `,x/foo/ { +1 d }`, "a1\nfoo x\nfoo y\nfoo z\n"},
+		{"abc", `,x/b/ {}`, "abc"},
+		{"abc", ",x/b/ {\n}\n,x/c/ { { } d }", "ab"},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			ed, _ := text.Open(text.NewBuffer())
+			ed.Insert([]byte(v.in), 0)
+			ed.Select(0, 0)
+			cmd, err := Compile(v.prog)
+			if err != nil {
+				t.Fatalf("failed: %s\n", err)
+			}
+			if err := cmd.Run(ed); err != nil {
+				t.Fatalf("run: %s", err)
+			}
+			if s := string(ed.Bytes()); s != v.want {
+				t.Fatalf("have: %q\nwant: %q\n", s, v.want)
+			}
+		})
+	}
+}
+
+type markEditor struct {
+	text.Editor
+	marks Marks
+}
+
+func (m *markEditor) Marks() Marks { return m.marks }
+func (m *markEditor) WriteAt(p []byte, at int64) (int, error) {
+	return m.Editor.(io.WriterAt).WriteAt(p, at)
+}
+
+func TestMark(t *testing.T) {
+	for i, v := range []struct {
+		in   string
+		prog []string
+		want string
+	}{
+		{"abcd", []string{`{ #1,#2 k ' c/X/ }`}, "aXcd"},
+		{"abcd", []string{`{ #1,#3 kq #0 k 'q c/X/ }`}, "aXd"},
+		{"abcd", []string{`#2,#3 k`, `' c/X/`}, "abXd"},
+		{"abcd", []string{`#2,#3 k`, `#0 i/XX/`, `' c/Y/`}, "XXabYd"},
+		{"abcd", []string{`#2,#3 k`, `#0,#1 d`, `' c/Y/`}, "bYd"},
+		{"abcd", []string{`#2,#3 kz`, `#3 a/QQ/`, `'z d`}, "abQQd"},
+		{"abcd", []string{`#1,#2 k a`, `'a c/X/`}, "aXcd"},
+		{"abcd", []string{"{\n#1,#2 k\tb\n'b d\n}"}, "acd"},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			b, _ := text.Open(text.NewBuffer())
+			ed := &markEditor{Editor: b, marks: Marks{}}
+			ed.Insert([]byte(v.in), 0)
+			for _, prog := range v.prog {
+				ed.Select(0, 0)
+				cmd, err := Compile(prog)
+				if err != nil {
+					t.Fatalf("failed: %s\n", err)
+				}
+				if err := cmd.Run(ed); err != nil {
+					t.Fatalf("run: %s", err)
+				}
+			}
+			if s := string(ed.Bytes()); s != v.want {
+				t.Fatalf("have: %q\nwant: %q\n", s, v.want)
+			}
+		})
+	}
+}
+
+func TestReadCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "edit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(name, []byte("new contents"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range []tbl{
+		{"old", "e " + name, "new contents"},
+		{"old", "e," + name + ",", "new contents"},
+		{"old\ntext", "2 e " + name, "new contents"},
+		{"one two", "#4,#7 r " + name, "one new contents"},
+		{"one two", "/two/ < echo three", "one three\n"},
+		{"one two", ",x/o/ < echo 0", "0\nne tw0\n"},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			ed, _ := text.Open(text.NewBuffer())
+			ed.Insert([]byte(v.in), 0)
+			ed.Select(0, 0)
+			cmd, err := Compile(v.prog)
+			if err != nil {
+				t.Fatalf("failed: %s\n", err)
+			}
+			if err := cmd.Run(ed); err != nil {
+				t.Fatalf("run: %s", err)
+			}
+			if s := string(ed.Bytes()); s != v.want {
+				t.Fatalf("have: %q\nwant: %q\n", s, v.want)
+			}
+		})
+	}
+}
+
+type sender []string
+
+func (s *sender) Send(e interface{})      { *s = append(*s, fmt.Sprint(e)) }
+func (s *sender) SendFirst(e interface{}) { *s = append([]string{fmt.Sprint(e)}, *s...) }
+
+func TestShell(t *testing.T) {
+	for i, v := range []struct {
+		prog, want, out string
+	}{
+		{"! echo hello", "text", "hello\n"},
+		{"! echo $%", "text", "file.go\n"},
+		{",x/t/ ! echo $%", "text", "file.go\nfile.go\n"},
+		{"< echo $%", "file.go\ntext", ""},
+		{",| sed s/x/$%/", "tefile.got", ""},
+		{",| sed 's/e/ e /'", "t e xt", ""},
+		{"! echo a | tr a b", "text", "b\n"},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			ed, _ := text.Open(text.NewBuffer())
+			ed.Insert([]byte("text"), 0)
+			ed.Select(0, 0)
+			var out sender
+			cmd, err := Compile(v.prog, &Options{Sender: &out, Origin: "file.go"})
+			if err != nil {
+				t.Fatalf("failed: %s\n", err)
+			}
+			if err := cmd.Run(ed); err != nil {
+				t.Fatalf("run: %s", err)
+			}
+			if s := string(ed.Bytes()); s != v.want {
+				t.Fatalf("have: %q\nwant: %q\n", s, v.want)
+			}
+			if s := strings.Join(out, ""); s != v.out {
+				t.Fatalf("output: have: %q\nwant: %q\n", s, v.out)
+			}
+		})
+	}
+}
+
+func TestSubmatch(t *testing.T) {
+	for i, v := range []tbl{
+		{"Oh peter", `,s/peter/& & &/g`, `Oh peter peter peter`},
+		{"key=value", `,s/(\w+)=(\w+)/\2=\1/`, `value=key`},
+		{"a=1 b=2", `,s/(\w)=(\d)/\2\1/g`, `1a 2b`},
+		{"a=1 b=2", `,s2/(\w)=(\d)/\2\1/`, `a=1 2b`},
+		{"f(x, y)", `,s/(?P<fn>\w+)\((?P<args>[^)]*)\)/\{args} \{fn}/`, `x, y f`},
+		{"ab", `,s/(a)(b)/\{2}\{1}/`, `ba`},
+		{"a&b", `,s/&/\&\&/`, `a&&b`},
+		{"a&b", `,s/a/\\/`, `\&b`},
+		{"ab", `,s/b/\n/`, "a\n"},
+		{"ab", `,s/(x)?b/[\1]/`, "a[]"},
+		{"abc", `,s/x*/-/g`, "-a-b-c-"},
+		{"éa世", `,s/x*/-/g`, "-é-a-世-"},
+		{"é世", `,s2/x*/-/`, "é-世"},
+		{"one two one", `/two/,$ s/one/1/`, "one two 1"},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			ed, _ := text.Open(text.NewBuffer())
+			ed.Insert([]byte(v.in), 0)
+			ed.Select(0, 0)
+			cmd, err := Compile(v.prog)
+			if err != nil {
+				t.Fatalf("failed: %s\n", err)
+			}
+			if err := cmd.Run(ed); err != nil {
+				t.Fatalf("run: %s", err)
+			}
+			if s := string(ed.Bytes()); s != v.want {
+				t.Fatalf("have: %q\nwant: %q\n", s, v.want)
+			}
+		})
+	}
+}
+
+func TestRegexpBack(t *testing.T) {
+	for i, v := range []struct {
+		in     string
+		q0, q1 int64
+		prog   string
+		want   string
+	}{
+		{"foo bar foo baz", 15, 15, `?foo? c/X/`, "foo bar X baz"},
+		{"foo bar foo baz", 15, 15, `-/foo/ c/X/`, "foo bar X baz"},
+		{"foo bar foo baz", 11, 15, `+?foo? c/X/`, "foo bar X baz"},
+		{"foo bar foo baz", 8, 11, `?foo? c/X/`, "X bar foo baz"},
+		{"foo bar foo baz", 0, 3, `-?foo? c/X/`, "foo bar X baz"},
+		{"aaa", 3, 3, `?aa? c/X/`, "aX"},
+		{"ab abc", 6, 6, `?b|abc? c/X/`, "ab X"},
+		{"one\ntwo\n", 8, 8, `-/(?m)^t/ c/T/`, "one\nTwo\n"},
+		{"héllo héllo", 13, 13, `?é? c/E/`, "héllo hEllo"},
+		{"foo bar foo baz", 15, 15, `?foo?,/baz/ d`, "foo bar "},
+		{"foo bar baz", 11, 11, `#0,?bar? d`, " baz"},
+		{"foo bar baz", 11, 11, `#0;?bar? d`, " baz"},
+		{"foo bar foo baz", 8, 11, `.-/foo/ c/X/`, "X bar foo baz"},
+		{"foo bar foo baz", 12, 15, `.+?foo? c/X/`, "foo bar X baz"},
+		{"foo bar foo baz", 0, 0, `#5-/foo/ c/X/`, "X bar foo baz"},
+		{"foo bar foo baz", 0, 0, `#5+/foo/ c/X/`, "foo bar X baz"},
+		{"foo bar foo baz", 0, 3, `/baz/-/foo/ c/X/`, "foo bar X baz"},
+		{"one\ntwo\nthree\n", 0, 0, `2+ d`, "one\ntwo\n"},
+		{"one\ntwo\nthree\n", 0, 0, `/three/-/o/ c/X/`, "one\ntwX\nthree\n"},
+		{"one\ntwo\nthree\n", 0, 0, `/three/- d`, "one\nthree\n"},
+		{"one\ntwo\nthree\n", 10, 10, `-1 d`, "one\nthree\n"},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			ed, _ := text.Open(text.NewBuffer())
+			ed.Insert([]byte(v.in), 0)
+			ed.Select(v.q0, v.q1)
+			cmd, err := Compile(v.prog)
+			if err != nil {
+				t.Fatalf("failed: %s\n", err)
+			}
+			if err := cmd.Run(ed); err != nil {
+				t.Fatalf("run: %s", err)
+			}
+			if s := string(ed.Bytes()); s != v.want {
+				t.Fatalf("have: %q\nwant: %q\n", s, v.want)
+			}
+		})
+	}
+}
+
+func TestSearchWrap(t *testing.T) {
+	for i, v := range []struct {
+		in     string
+		q0, q1 int64
+		prog   string
+		want   string
+		err    error
+	}{
+		{"foo bar baz", 8, 11, `/foo/ c/X/`, "X bar baz", nil},
+		{"foo bar baz", 0, 3, `?baz? c/X/`, "foo bar X", nil},
+		{"foo bar baz", 0, 3, `-/bar/ c/X/`, "foo X baz", nil},
+		{"foo bar", 0, 0, `/qux/ c/X/`, "foo bar", ErrSearch},
+		{"foo bar", 7, 7, `?qux? c/X/`, "foo bar", ErrSearch},
+		{"foo bar", 0, 0, `,x/o/ { /qux/ d }`, "foo bar", ErrSearch},
+		{"foo bar", 0, 0, `,x/o/ { d /qux/ d }`, "foo bar", ErrSearch},
+		{"foo bar", 0, 0, `/foo/,/qux/ d`, "foo bar", ErrSearch},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			ed, _ := text.Open(text.NewBuffer())
+			ed.Insert([]byte(v.in), 0)
+			ed.Select(v.q0, v.q1)
+			cmd, err := Compile(v.prog)
+			if err != nil {
+				t.Fatalf("failed: %s\n", err)
+			}
+			if err = cmd.Run(ed); !errors.Is(err, v.err) {
+				t.Fatalf("error: have %v, want %v", err, v.err)
+			}
+			if s := string(ed.Bytes()); s != v.want {
+				t.Fatalf("have: %q\nwant: %q\n", s, v.want)
+			}
+		})
+	}
+}
+
+func TestRunError(t *testing.T) {
+	for i, v := range []struct {
+		prog string
+		cmd  string
+		pos  int
+		n    int
+	}{
+		{"w /nonexistent/dir/file", "w", 0, 1},
+		{"r /nonexistent/file", "r", 0, 1},
+		{"| false", "|", 0, 1},
+		{",x/o/ | false", "|", 6, 2},
+		{",x/o/ { c/0/\n| false\n}", "|", 13, 2},
+		{",x/o/ { c/0/ /qux/ d }", "d", 19, 2},
+		{"/qux/ d", "", 1, 1},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			ed, _ := text.Open(text.NewBuffer())
+			ed.Insert([]byte("foo"), 0)
+			ed.Select(0, 0)
+			cmd, err := Compile(v.prog)
+			if err != nil {
+				t.Fatalf("failed: %s\n", err)
+			}
+			err = cmd.Run(ed)
+			var e Errors
+			if !errors.As(err, &e) || len(e) != 1 {
+				t.Fatalf("have error %v, want one command error", err)
+			}
+			if e[0].Cmd != v.cmd || e[0].Pos != v.pos || e[0].N != v.n {
+				t.Fatalf("have %q at %d (%d times), want %q at %d (%d times)", e[0].Cmd, e[0].Pos, e[0].N, v.cmd, v.pos, v.n)
+			}
+			if s := string(ed.Bytes()); s != "foo" {
+				t.Fatalf("editor changed: %q", s)
+			}
+		})
+	}
+}
+
+func TestCompileError(t *testing.T) {
+	for _, prog := range []string{
+		`,x/(/ d`,
+		`,s/(/x/`,
+		`,s/(a)/\2/`,
+		`/(/ d`,
+		`{ d`,
+		`,Q`,
+		`,d}`,
+		`k ab`,
+		`k A`,
+	} {
+		if _, err := Compile(prog); err == nil {
+			t.Errorf("%q: compiled without error", prog)
+		}
+	}
+}
+
+func TestSyntaxError(t *testing.T) {
+	for _, tc := range []struct {
+		prog      string
+		line, col int
+		kind      Kind
+		render    string
+	}{
+		{",Q", 1, 2, kindCmd, "1:2: unknown command \"Q\"\n,Q\n ^"},
+		{",x/(/ d", 1, 4, kindArg, ""},
+		{",s/(a)/\\2/", 1, 8, kindArg, ""},
+		{",d}", 1, 3, kindErr, ""},
+		{"{\n\td\n\tQ\n}", 3, 2, kindCmd, "3:2: unknown command \"Q\"\n\tQ\n\t^"},
+	} {
+		_, err := Compile(tc.prog)
+		var se *SyntaxError
+		if !errors.As(err, &se) {
+			t.Errorf("%q: have %v, want *SyntaxError", tc.prog, err)
+			continue
+		}
+		if se.Line != tc.line || se.Col != tc.col || se.Kind != tc.kind {
+			t.Errorf("%q: have %d:%d %s, want %d:%d %s", tc.prog, se.Line, se.Col, se.Kind, tc.line, tc.col, tc.kind)
+		}
+		if tc.render != "" && se.Error() != tc.render {
+			t.Errorf("%q: have\n%s\nwant\n%s", tc.prog, se, tc.render)
+		}
+	}
+}
+
+func TestScript(t *testing.T) {
+	script := "# mark the vowels\n,x/[aeiou]/ i/</\n\n# then drop the b's\n,x/b/ d # every one\n"
+	for i, v := range []struct {
+		in      string
+		prog    string
+		perLine bool
+		want    string
+	}{
+		{"abc", script, false, "<ac"},
+		{"abc", script, true, "<ac"},
+		{"abc", ",x/a/ c/b/\n,x/b/ c/c/", false, "bcc"},
+		{"abc", ",x/a/ c/b/\n,x/b/ c/c/", true, "ccc"},
+		{"abc", "#1,#2 d\n#0 i/x/", false, "xac"},
+		{"abc", "#1 a/1/\n#1 a/2/\n", false, "a12bc"},
+		{"abc", "\n\n# nothing\n", false, "abc"},
+		{"abcdef", "# 3 i/x/\n#\tthe end", false, "abcxdef"},
+		{"abcdef", "#0,# 3 d", false, "def"},
+		{"abcdef", "#1,#2 d # 3", false, "acdef"},
+		{"abc", "#1 a/x/ , \n#0,#1 d,", true, "xbc"},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			ed, _ := text.Open(text.NewBuffer())
+			ed.Insert([]byte(v.in), 0)
+			ed.Select(0, 0)
+			cmd, err := CompileReader(strings.NewReader(v.prog), &Options{PerLine: v.perLine})
+			if err != nil {
+				t.Fatalf("failed: %s\n", err)
+			}
+			if err = cmd.Run(ed); err != nil {
+				t.Fatalf("run: %s\n", err)
+			}
+			if s := string(ed.Bytes()); s != v.want {
+				t.Fatalf("have: %q\nwant: %q\n", s, v.want)
+			}
+		})
+	}
+}
+
+func TestCompileFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "edit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "bad.sam")
+	if err := ioutil.WriteFile(name, []byte(",x/a/ d\n,Q\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	_, err = CompileFile(name)
+	var se *SyntaxError
+	if !errors.As(err, &se) {
+		t.Fatalf("have %v, want *SyntaxError", err)
+	}
+	if se.Name != name || se.Line != 2 || se.Col != 2 {
+		t.Fatalf("have %s:%d:%d, want %s:2:2", se.Name, se.Line, se.Col, name)
+	}
+}
+
+func TestText(t *testing.T) {
+	long := strings.Repeat("0123456789", 2000)
+	for i, v := range []tbl{
+		{"ab", "#1 a\nx\ny\n.\n", "ax\ny\nb"},
+		{"ab", "#1 i\n.\n", "ab"},
+		{"ab", ",c\n\tif a/b {\n\t\treturn \"/\"\n\t}\n.", "\tif a/b {\n\t\treturn \"/\"\n\t}\n"},
+		{"ab", "#1 a\n..\n.\n#0 i/>/", ">a..\nb"},
+		{"ab", ",x/b/ {\n\ta\n!\n.\n\ti/</\n}", "a<b!\n"},
+		{"ab", `,c/a\/b/`, "a/b"},
+		{"ab", `,c/say "\/"/`, `say "/"`},
+		{"a/b", `,x/\// c/\\/`, `a\b`},
+		{"a/b", `,s/\//\//g`, "a/b"},
+		{"a/b", `,s,/,\,,g`, "a,b"},
+		{"a/b", `/a\/b/ c/c/`, "c"},
+		{"ab", ",c/" + long + "/", long},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			ed, _ := text.Open(text.NewBuffer())
+			ed.Insert([]byte(v.in), 0)
+			ed.Select(0, 0)
+			cmd, err := Compile(v.prog)
+			if err != nil {
+				t.Fatalf("failed: %s\n", err)
+			}
+			if err = cmd.Run(ed); err != nil {
+				t.Fatalf("run: %s\n", err)
+			}
+			if s := string(ed.Bytes()); s != v.want {
+				t.Fatalf("have: %q\nwant: %q\n", s, v.want)
+			}
+		})
+	}
+	if _, err := Compile("a\nno end\n"); err == nil {
+		t.Fatal("unterminated text compiled without error")
+	}
+}
+
+func TestInvert(t *testing.T) {
+	for i, v := range []tbl{
+		{"abc", ",d", ""},
+		{"abc", "#1 a/xyz/", ""},
+		{"abcdef", `,x/b|d/ c/BB/`, ""},
+		{"abcdef", `,x/bc|ef/ c/Z/`, ""},
+		{"abcdef", `#2 { i/1/ i/2/ a/3/ d }`, ""},
+		{"abcdef", `{ #1,#3 { d i/x/ } #3 a/y/ }`, ""},
+		{"a\nb\nc\n", `,x/.*\n/ { i/> / a/!\n/ }`, ""},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			ed, _ := text.Open(text.NewBuffer())
+			ed.Insert([]byte(v.in), 0)
+			ed.Select(0, 0)
+			cmd, err := Compile(v.prog)
+			if err != nil {
+				t.Fatalf("failed: %s\n", err)
+			}
+			log, err := cmd.Transcribe(ed)
+			if err != nil {
+				t.Fatalf("transcribe: %s\n", err)
+			}
+			inv, err := Invert(ed, log)
+			if err != nil {
+				t.Fatalf("invert: %s\n", err)
+			}
+			Commit(ed, log)
+			changed := string(ed.Bytes())
+			Commit(ed, inv)
+			if s := string(ed.Bytes()); s != v.in {
+				t.Fatalf("have: %q\nwant: %q\n(changed: %q)", s, v.in, changed)
+			}
+		})
+	}
+}
+
+func TestUndo(t *testing.T) {
+	ed, _ := text.Open(text.NewBuffer())
+	ed.Insert([]byte("abc"), 0)
+	u := NewUndo(ed)
+	run := func(prog, want string) {
+		t.Helper()
+		cmd, err := Compile(prog, &Options{PerLine: true})
+		if err != nil {
+			t.Fatalf("failed: %s\n", err)
+		}
+		if err = u.Run(cmd); err != nil {
+			t.Fatalf("%q: %s\n", prog, err)
+		}
+		if s := string(ed.Bytes()); s != want {
+			t.Fatalf("%q: have %q, want %q\n", prog, s, want)
+		}
+	}
+	run(",x/b/ d", "ac")
+	run(",x/c/ c/CC/", "aCC")
+	run("u", "ac")
+	run("u", "abc")
+	run("u", "abc")
+	run("u -2", "aCC")
+	run("u\nu -1", "aCC")
+	run(",x/a/ c/A/\nu 2", "ac")
+	if undo, redo := u.Len(); undo != 1 || redo != 2 {
+		t.Fatalf("have %d undo and %d redo, want 1 and 2", undo, redo)
+	}
+	run("#0 i/>/", ">ac")
+	if _, redo := u.Len(); redo != 0 {
+		t.Fatalf("redo history kept after a new change")
+	}
+	if err := MustCompile("u").Run(ed); !errors.Is(err, ErrNoUndo) {
+		t.Fatalf("have %v, want %v", err, ErrNoUndo)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	in := "one\ntwo\nthree\nfour\nfive\nsix\nseven\neight\nnine\nten\n"
+	for i, v := range []struct {
+		in, prog string
+		ctx      int
+		want     string
+	}{
+		{in, ",x/nothing/ d", 0, ""},
+		{in, "/two/ c/2/", 1, "--- f\n+++ f\n@@ -1,3 +1,3 @@\n one\n-two\n+2\n three\n"},
+		{in, "/two/ c/2/\n/nine/ c/9/", 1, "--- f\n+++ f\n@@ -1,3 +1,3 @@\n one\n-two\n+2\n three\n@@ -8,3 +8,3 @@\n eight\n-nine\n+9\n ten\n"},
+		{in, "/two/ c/2/\n/five/ c/5/", 1, "--- f\n+++ f\n@@ -1,6 +1,6 @@\n one\n-two\n+2\n three\n four\n-five\n+5\n six\n"},
+		{in, "1 i/zero\n/", -1, "--- f\n+++ f\n@@ -0,0 +1 @@\n+zero\n"},
+		{in, "10 d", -1, "--- f\n+++ f\n@@ -10 +9,0 @@\n-ten\n"},
+		{"a\nb", "/b/ c/c/", -1, "--- f\n+++ f\n@@ -2 +2 @@\n-b\n\\ No newline at end of file\n+c\n\\ No newline at end of file\n"},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			ed, _ := text.Open(text.NewBuffer())
+			ed.Insert([]byte(v.in), 0)
+			ed.Select(0, 0)
+			cmd, err := Compile(v.prog, &Options{Origin: "f", Context: v.ctx})
+			if err != nil {
+				t.Fatalf("failed: %s\n", err)
+			}
+			d, err := cmd.Diff(ed)
+			if err != nil {
+				t.Fatalf("diff: %s\n", err)
+			}
+			if string(d) != v.want {
+				t.Fatalf("have:\n%s\nwant:\n%s\n", d, v.want)
+			}
+			if string(ed.Bytes()) != v.in {
+				t.Fatalf("diff changed the editor: %q", ed.Bytes())
+			}
+		})
+	}
+	t.Run("dry", func(t *testing.T) {
+		fsys := memFS{fstest.MapFS{}}
+		ran := false
+		exec := ExecFunc(func(ctx context.Context, line string, stdin []byte) ([]byte, error) {
+			ran = true
+			return stdin, nil
+		})
+		ed, _ := text.Open(text.NewBuffer())
+		ed.Insert([]byte("text"), 0)
+		cmd, err := Compile(",c/new/\n,w out.txt\n,> out2.txt", &Options{FS: fsys, Exec: exec})
+		if err != nil {
+			t.Fatalf("failed: %s\n", err)
+		}
+		if d, err := cmd.Diff(ed); err != nil || len(d) == 0 {
+			t.Fatalf("diff: %q %v", d, err)
+		}
+		if len(fsys.MapFS) != 0 {
+			t.Fatalf("dry run wrote files: %v", fsys.MapFS)
+		}
+		cmd, err = Compile(",| cat", &Options{Exec: exec})
+		if err != nil {
+			t.Fatalf("failed: %s\n", err)
+		}
+		if _, err = cmd.Diff(ed); !errors.Is(err, ErrDryRun) || ran {
+			t.Fatalf("have %v, want %v", err, ErrDryRun)
+		}
+		if err = cmd.Run(ed); err != nil || !ran {
+			t.Fatalf("run after diff: %v", err)
+		}
+	})
+}
+
+func TestConflict(t *testing.T) {
+	for i, v := range []struct {
+		prog string
+		a, b Overlap
+	}{
+		{`,x/ab/ { c/X/ c/Y/ }`, Overlap{"c", 9, Dot{0, 1}}, Overlap{"c", 14, Dot{0, 1}}},
+		{`,x/abc/ { x/b/ d d }`, Overlap{"d", 17, Dot{0, 3}}, Overlap{"d", 15, Dot{1, 2}}},
+		{`#0,#3 m #2`, Overlap{"m", 6, Dot{0, 3}}, Overlap{"m", 6, Dot{2, 2}}},
+		{`,x/abc/ { d x/b/ i/-/ }`, Overlap{"d", 10, Dot{0, 3}}, Overlap{"i", 17, Dot{1, 1}}},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			ed, _ := text.Open(text.NewBuffer())
+			ed.Insert([]byte("abcd"), 0)
+			ed.Select(0, 0)
+			cmd, err := Compile(v.prog)
+			if err != nil {
+				t.Fatalf("failed: %s\n", err)
+			}
+			err = cmd.Run(ed)
+			var ce *ConflictError
+			if !errors.As(err, &ce) {
+				t.Fatalf("have %v, want *ConflictError", err)
+			}
+			if ce.A != v.a || ce.B != v.b {
+				t.Fatalf("have %s and %s\nwant %s and %s", ce.A, ce.B, v.a, v.b)
+			}
+			if s := string(ed.Bytes()); s != "abcd" {
+				t.Fatalf("conflicting program changed the text: %q", s)
+			}
+		})
+	}
+}
+
+func TestMoveCopy(t *testing.T) {
+	for i, v := range []tbl{
+		{"abcd", `#0,#1 m $`, "bcda"},
+		{"abcd", `#0,#1 t $`, "abcda"},
+		{"abcd", `/c/ m #0`, "cabd"},
+		{"abcd", `#1,#3 m #1`, "abcd"},
+		{"ab\ncd\n", "{\n\t1 m $\n}", "cd\nab\n"},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			ed, _ := text.Open(text.NewBuffer())
+			ed.Insert([]byte(v.in), 0)
+			ed.Select(0, 0)
+			cmd, err := Compile(v.prog)
+			if err != nil {
+				t.Fatalf("failed: %s\n", err)
+			}
+			if err = cmd.Run(ed); err != nil {
+				t.Fatalf("run: %s\n", err)
+			}
+			if s := string(ed.Bytes()); s != v.want {
+				t.Fatalf("have: %q\nwant: %q\n", s, v.want)
+			}
+		})
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i, v := range []struct {
+		prog string
+		ctx  context.Context
+	}{
+		{",x/a/ d", cancelled},
+		{",y/a/ d", cancelled},
+		{",s/a/b/g", cancelled},
+		{",| sleep 10", nil},
+		{",ka\n,| sleep 10", nil},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			ctx := v.ctx
+			if ctx == nil {
+				var cancel func()
+				ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+				defer cancel()
+			}
+			ed, _ := text.Open(text.NewBuffer())
+			ed.Insert([]byte("banana"), 0)
+			ed.Select(1, 2)
+			cmd, err := Compile(v.prog)
+			if err != nil {
+				t.Fatalf("failed: %s\n", err)
+			}
+			start := time.Now()
+			err = cmd.RunContext(ctx, ed)
+			if err != ctx.Err() {
+				t.Fatalf("have %v, want %v", err, ctx.Err())
+			}
+			if d := time.Since(start); d > 5*time.Second {
+				t.Fatalf("cancelled run took %s", d)
+			}
+			if s := string(ed.Bytes()); s != "banana" {
+				t.Fatalf("cancelled run changed the text: %q", s)
+			}
+			if q0, q1 := ed.Dot(); q0 != 1 || q1 != 2 {
+				t.Fatalf("dot: have #%d,#%d, want #1,#2", q0, q1)
+			}
+			if len(*cmd.marks) != 0 {
+				t.Fatalf("cancelled run set marks: %v", *cmd.marks)
+			}
+		})
+	}
+}
+
+func TestLimits(t *testing.T) {
+	for i, v := range []struct {
+		prog  string
+		lim   Limits
+		limit string
+	}{
+		{",x/a/ d", Limits{Loops: 2}, "Loops"},
+		{",x/./ y/a/ d", Limits{Loops: 8}, "Loops"},
+		{",s/a/b/g", Limits{Matches: 2}, "Matches"},
+		{",x/a/ a/xx/", Limits{Insert: 5}, "Insert"},
+		{",x/a/ p", Limits{Output: 2}, "Output"},
+		{",| sleep 10", Limits{Runtime: 50 * time.Millisecond}, "Runtime"},
+		{",s/a/b/g", Limits{Matches: 3, Loops: 1, Insert: 3}, ""},
+		{",x/an/ c/XY/", Limits{Insert: 3}, "Insert"},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			ed, _ := text.Open(text.NewBuffer())
+			ed.Insert([]byte("banana"), 0)
+			ed.Select(0, 0)
+			cmd, err := Compile(v.prog, &Options{Sender: &sender{}, Limits: v.lim})
+			if err != nil {
+				t.Fatalf("failed: %s\n", err)
+			}
+			err = cmd.Run(ed)
+			if v.limit == "" {
+				if err != nil {
+					t.Fatalf("run: %s", err)
+				}
+				return
+			}
+			var le *LimitError
+			if !errors.As(err, &le) || le.Limit != v.limit {
+				t.Fatalf("have %v, want %s limit exceeded", err, v.limit)
+			}
+			if s := string(ed.Bytes()); s != "banana" {
+				t.Fatalf("run over the limit changed the text: %q", s)
+			}
+		})
+	}
+
+	// With PerLine, the lines before the one over the limit
+	// are committed
+	ed, _ := text.Open(text.NewBuffer())
+	ed.Insert([]byte("banana"), 0)
+	cmd, err := Compile(",x/b/ c/B/\n,x/a/ a/xx/", &Options{PerLine: true, Limits: Limits{Insert: 4}})
+	if err != nil {
+		t.Fatalf("failed: %s\n", err)
+	}
+	var le *LimitError
+	if err = cmd.Run(ed); !errors.As(err, &le) || le.Limit != "Insert" {
+		t.Fatalf("have %v, want Insert limit exceeded", err)
+	}
+	if s := string(ed.Bytes()); s != "Banana" {
+		t.Fatalf("have: %q\nwant: %q\n", s, "Banana")
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	sb := &Sandbox{Files: []string{"/tmp/ok", "/tmp/dir/*.txt"}, Exec: []string{"echo", "tr"}}
+	for i, v := range []struct {
+		prog string
+		sb   *Sandbox
+		ok   bool
+	}{
+		{",d", &Sandbox{}, true},
+		{",r /tmp/ok", &Sandbox{}, false},
+		{",| tr a b", &Sandbox{}, false},
+		{",r /tmp/ok", sb, true},
+		{",w /tmp/../tmp/ok", sb, true},
+		{",w /tmp/dir/a.txt", sb, true},
+		{",w /tmp/dir/a.go", sb, false},
+		{",e /etc/passwd", sb, false},
+		{",> /tmp/other", sb, false},
+		{",| tr a b", sb, true},
+		{",< echo hi", sb, true},
+		{",! rm -rf /", sb, false},
+		{",x/a/ {\n\td\n\t! sh\n}", sb, false},
+		{",x/a/ {\n\td\n\t! echo a\n}", sb, true},
+		{",| rm x", nil, true},
+		{",| tr 'a;b' c", sb, true},
+		{",| tr a b; rm x", sb, false},
+		{",| tr a b | sh", sb, false},
+		{",< echo $(rm x)", sb, false},
+		{",< echo \"`rm x`\"", sb, false},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			_, err := Compile(v.prog, &Options{Sandbox: v.sb})
+			if v.ok && err != nil {
+				t.Fatalf("have %v, want no error", err)
+			}
+			var se *SyntaxError
+			if !v.ok && !errors.As(err, &se) {
+				t.Fatalf("have %v, want *SyntaxError", err)
+			}
+		})
+	}
+}
+
+func TestSandboxLink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "edit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+	ok := filepath.Join(dir, "ok")
+	if err = os.Mkdir(ok, 0777); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"secret", "ok/b.txt"} {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, to := range map[string]string{"a.txt": "b.txt", "secret.txt": "../secret", "gone.txt": "../gone", "up": ".."} {
+		if err = os.Symlink(to, filepath.Join(ok, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sb := &Sandbox{Files: []string{ok + "/*.txt", ok + "/*/*.txt"}}
+	for i, v := range []struct {
+		prog string
+		ok   bool
+	}{
+		{",r ok/b.txt", true},
+		{",r ok/a.txt", true},
+		{",w ok/new.txt", true},
+		{",r ok/secret.txt", false},
+		{",w ok/gone.txt", false},
+		{",w ok/up/new.txt", false},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			_, err := Compile(v.prog, &Options{Sandbox: sb, Origin: filepath.Join(dir, "f")})
+			if v.ok && err != nil {
+				t.Fatalf("have %v, want no error", err)
+			}
+			var se *SyntaxError
+			if !v.ok && !errors.As(err, &se) {
+				t.Fatalf("have %v, want *SyntaxError", err)
+			}
+		})
+	}
+}
+
+func TestExec(t *testing.T) {
+	var lines, input []string
+	fake := ExecFunc(func(ctx context.Context, line string, stdin []byte) ([]byte, error) {
+		lines, input = append(lines, line), append(input, string(stdin))
+		return bytes.ToUpper(stdin), nil
+	})
+	ed, _ := text.Open(text.NewBuffer())
+	ed.Insert([]byte("one two"), 0)
+	cmd, err := Compile(",x/two/ | upper 'a b'", &Options{Exec: fake})
+	if err != nil {
+		t.Fatalf("failed: %s\n", err)
+	}
+	if err = cmd.Run(ed); err != nil {
+		t.Fatalf("failed: %s\n", err)
+	}
+	if s := string(ed.Bytes()); s != "one TWO" {
+		t.Fatalf("have: %q\nwant: %q\n", s, "one TWO")
+	}
+	if len(lines) != 1 || lines[0] != "upper 'a b'" || input[0] != "two" {
+		t.Fatalf("bad exec: %q %q", lines, input)
+	}
+
+	sh := &ShellExecutor{Env: []string{"X=env"}, Dir: "/"}
+	out, err := sh.Exec(context.Background(), "echo $X; pwd", nil)
+	if err != nil {
+		t.Fatalf("failed: %s\n", err)
+	}
+	if s := string(out); s != "env\n/\n" {
+		t.Fatalf("have: %q\nwant: %q\n", s, "env\n/\n")
+	}
+
+	cmd, err = Compile("! echo oops >&2; exit 3")
+	if err != nil {
+		t.Fatalf("failed: %s\n", err)
+	}
+	var xe *ExecError
+	if err = cmd.Run(ed); !errors.As(err, &xe) {
+		t.Fatalf("have %v, want *ExecError", err)
+	}
+	if xe.ExitCode() != 3 || string(xe.Stderr) != "oops\n" {
+		t.Fatalf("bad error: %d %q", xe.ExitCode(), xe.Stderr)
+	}
+}
+
+type memFS struct{ fstest.MapFS }
+
+func (m memFS) WriteFile(name string, p []byte) error {
+	m.MapFS[name] = &fstest.MapFile{Data: append([]byte{}, p...)}
+	return nil
+}
+
+func TestFS(t *testing.T) {
+	for i, v := range []struct {
+		prog, want string
+		file, data string
+	}{
+		{",r other.txt", "other", "", ""},
+		{",r ../lib/lib.txt", "lib", "", ""},
+		{",r /lib/lib.txt", "lib", "", ""},
+		{",e other.txt", "other", "", ""},
+		{",w out.txt", "text", "src/out.txt", "text"},
+		{"#1,#3 > /tmp/out.txt", "text", "tmp/out.txt", "ex"},
+		{"#1,#3 > $%.bak", "text", "src/main.go.bak", "ex"},
+		{"#1,#3 > out.txt", "text", "src/out.txt", "ex"},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			fsys := memFS{fstest.MapFS{
+				"src/other.txt": {Data: []byte("other")},
+				"lib/lib.txt":   {Data: []byte("lib")},
+			}}
+			ed, _ := text.Open(text.NewBuffer())
+			ed.Insert([]byte("text"), 0)
+			ed.Select(0, 0)
+			cmd, err := Compile(v.prog, &Options{Origin: "src/main.go", FS: fsys})
+			if err != nil {
+				t.Fatalf("failed: %s\n", err)
+			}
+			if err = cmd.Run(ed); err != nil {
+				t.Fatalf("run: %s", err)
+			}
+			if s := string(ed.Bytes()); s != v.want {
+				t.Fatalf("have: %q\nwant: %q\n", s, v.want)
+			}
+			if v.file == "" {
+				return
+			}
+			if f := fsys.MapFS[v.file]; f == nil || string(f.Data) != v.data {
+				t.Fatalf("%s: have %v, want %q", v.file, f, v.data)
+			}
+		})
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "edit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "file")
+	link := filepath.Join(dir, "link")
+	if err := ioutil.WriteFile(name, []byte("old"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(name, link); err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range []struct {
+		prog, file, want string
+		opts             Options
+	}{
+		{",w " + name, name, "text", Options{}},
+		{",w " + name, name + "~", "old", Options{Backup: true, Sync: true}},
+		{"#1,#3 > " + link, name, "ex", Options{}},
+		{",w " + filepath.Join(dir, "new"), filepath.Join(dir, "new"), "text", Options{Backup: true}},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			if err := ioutil.WriteFile(name, []byte("old"), 0640); err != nil {
+				t.Fatal(err)
+			}
+			ed, _ := text.Open(text.NewBuffer())
+			ed.Insert([]byte("text"), 0)
+			cmd, err := Compile(v.prog, &v.opts)
+			if err != nil {
+				t.Fatalf("failed: %s\n", err)
+			}
+			if err = cmd.Run(ed); err != nil {
+				t.Fatalf("run: %s", err)
+			}
+			p, err := ioutil.ReadFile(v.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s := string(p); s != v.want {
+				t.Fatalf("have: %q\nwant: %q\n", s, v.want)
+			}
+			if fi, err := os.Lstat(name); err != nil || fi.Mode() != 0640 {
+				t.Fatalf("mode: have %v, want %v", fi.Mode(), os.FileMode(0640))
+			}
+			if fi, err := os.Lstat(link); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+				t.Fatalf("link replaced: %v", err)
+			}
+		})
+	}
+	if _, err := os.Stat(filepath.Join(dir, "new~")); !os.IsNotExist(err) {
+		t.Fatalf("backup of new file: %v", err)
+	}
+	ents, _ := ioutil.ReadDir(dir)
+	if len(ents) != 4 {
+		t.Fatalf("temporary files left: %d entries", len(ents))
+	}
+
+	cmd, err := Compile(",w " + filepath.Join(dir, "missing", "file"))
+	if err != nil {
+		t.Fatalf("failed: %s\n", err)
+	}
+	ed, _ := text.Open(text.NewBuffer())
+	if err = cmd.Run(ed); err == nil {
+		t.Fatalf("write to missing directory succeeded")
+	}
+
+	// A bare name is written through a temporary file beside it,
+	// not in TMPDIR
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	t.Setenv("TMPDIR", filepath.Join(dir, "missing"))
+	if err := (osFS{}).WriteFile("file", []byte("bare")); err != nil {
+		t.Fatalf("bare name: %s", err)
+	}
+	if p, _ := ioutil.ReadFile(name); string(p) != "bare" {
+		t.Fatalf("have: %q\nwant: %q\n", p, "bare")
+	}
+}
+
+func TestWorkspace(t *testing.T) {
+	for i, v := range []struct {
+		prog string
+		want map[string]string
+		out  string
+		cur  string
+		disk map[string]string
+	}{
+		{`X/\.go$/ ,s/package/pkg/`, map[string]string{"a.go": "pkg a\n", "b.go": "pkg b\n", "c.txt": "text\n"}, "", "a.go", nil},
+		{`Y/\.go$/ ,d`, map[string]string{"a.go": "package a\n", "b.go": "package b\n", "c.txt": ""}, "", "a.go", nil},
+		{`X/\.go$/ ,=`, nil, "a.go:#1,#10\nb.go:#1,#10\n", "a.go", nil},
+		{`X/b/ /b/ c/x/`, map[string]string{"a.go": "package a\n", "b.go": "package x\n"}, "", "a.go", nil},
+		{"b b.go\n,d", map[string]string{"a.go": "package a\n", "b.go": ""}, "", "b.go", nil},
+		{"n", nil, " . a.go\n   b.go\n   c.txt\n", "a.go", nil},
+		{"1d\nn", nil, "'. a.go\n   b.go\n   c.txt\n", "a.go", nil},
+		{"f d.go\n=", map[string]string{"d.go": "package a\n"}, " . d.go\nd.go:#1,#0\n", "d.go", nil},
+		{"D\nn", map[string]string{"a.go": ""}, "   b.go\n   c.txt\n", "", nil},
+		{"B new.txt\na/hello/", map[string]string{"new.txt": "hello"}, "", "new.txt", nil},
+		{"B lib.txt\nw", map[string]string{"lib.txt": "lib"}, "", "lib.txt", map[string]string{"lib.txt": "lib"}},
+		{"B lib.txt\n$a/!/\nw", map[string]string{"lib.txt": "lib!"}, "", "lib.txt", map[string]string{"lib.txt": "lib!"}},
+		{"B lib.txt\n#1,#2 w part.txt", nil, "", "lib.txt", map[string]string{"lib.txt": "lib", "part.txt": "i"}},
+		{`X/\.go$/ w`, nil, "", "a.go", map[string]string{"a.go": "package a\n", "b.go": "package b\n", "c.txt": ""}},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			var out sender
+			fsys := memFS{fstest.MapFS{"lib.txt": {Data: []byte("lib")}}}
+			w := NewWorkspace(&Options{Sender: &out, FS: fsys})
+			for _, name := range []string{"c.txt", "b.go", "a.go"} {
+				ed, _ := text.Open(text.NewBuffer())
+				if name == "c.txt" {
+					ed.Insert([]byte("text\n"), 0)
+				} else {
+					ed.Insert([]byte("package "+name[:1]+"\n"), 0)
+				}
+				ed.Select(0, 0)
+				w.Add(name, ed)
+			}
+			if err := w.Run(v.prog); err != nil {
+				t.Fatalf("failed: %s\n", err)
+			}
+			for name, want := range v.want {
+				s := ""
+				if f := w.Lookup(name); f != nil {
+					s = string(f.Editor.Bytes())
+				}
+				if s != want {
+					t.Fatalf("%s: have: %q\nwant: %q\n", name, s, want)
+				}
+			}
+			for name, want := range v.disk {
+				s := ""
+				if f := fsys.MapFS[name]; f != nil {
+					s = string(f.Data)
+				}
+				if s != want {
+					t.Fatalf("disk: %s: have: %q\nwant: %q\n", name, s, want)
+				}
+			}
+			if s := strings.Join(out, "\n") + "\n"; len(out) != 0 && s != v.out || len(out) == 0 && v.out != "" {
+				t.Fatalf("output: have: %q\nwant: %q\n", s, v.out)
+			}
+			cur := ""
+			if f := w.Current(); f != nil {
+				cur = f.Name
+			}
+			if cur != v.cur {
+				t.Fatalf("current: have %q, want %q", cur, v.cur)
+			}
+		})
+	}
+
+	w := NewWorkspace()
+	if err := w.Run(",d"); err != ErrNoFile {
+		t.Fatalf("have %v, want %v", err, ErrNoFile)
+	}
+	fsys := memFS{fstest.MapFS{"lib.txt": {Data: []byte("lib")}}}
+	w = NewWorkspace(&Options{FS: fsys})
+	if err := w.Run("B lib.txt\n$a/!/\nw"); err != nil {
+		t.Fatalf("empty workspace: %s", err)
+	}
+	if s := string(fsys.MapFS["lib.txt"].Data); s != "lib!" {
+		t.Fatalf("empty workspace: have: %q\nwant: %q\n", s, "lib!")
+	}
+	if err := NewWorkspace().Run("w"); err == nil || !strings.Contains(err.Error(), "no file name") {
+		t.Fatalf("have %v, want no file name", err)
+	}
+	ed, _ := text.Open(text.NewBuffer())
+	if err := MustCompile("n").Run(ed); !errors.Is(err, ErrNoWorkspace) {
+		t.Fatalf("have %v, want %v", err, ErrNoWorkspace)
+	}
+
+	// The marks of a file outlive the program that set them
+	ed, _ = text.Open(text.NewBuffer())
+	ed.Insert([]byte("abcdef"), 0)
+	w = NewWorkspace()
+	w.Add("f", ed)
+	for _, prog := range []string{"#2,#3 k", "#0 i/>/", "' d"} {
+		if err := w.Run(prog); err != nil {
+			t.Fatalf("%s: %s", prog, err)
+		}
+	}
+	if s := string(ed.Bytes()); s != ">abdef" {
+		t.Fatalf("marks: have: %q\nwant: %q\n", s, ">abdef")
+	}
+}
+
+func TestApply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "edit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		".gitignore":   "*.log\nbuild/\n!keep.log\n",
+		".git/config":  "foo",
+		"a.txt":        "foo\n",
+		"sub/b.txt":    "foo bar\n",
+		"sub/x.log":    "foo\n",
+		"sub/keep.log": "foo\n",
+		"build/c.txt":  "foo\n",
+		"bin.dat":      "foo\x00",
+	}
+	for name, data := range files {
+		name = filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(name), 0777)
+		if err := ioutil.WriteFile(name, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	diff := new(bytes.Buffer)
+	sum, err := Apply(MustCompile(",x/foo/ c/baz/"), []string{dir}, &ApplyOptions{Diff: diff, Backup: ".orig"})
+	if err != nil {
+		t.Fatalf("failed: %s\n", err)
+	}
+	if sum.Files != 4 || sum.Changed != 3 || sum.Skipped != 1 || sum.Inserted != 9 || sum.Deleted != 9 {
+		t.Fatalf("bad summary: %+v", sum)
+	}
+	for name, want := range map[string]string{
+		"a.txt":        "baz\n",
+		"a.txt.orig":   "foo\n",
+		"sub/b.txt":    "baz bar\n",
+		"sub/keep.log": "baz\n",
+		"sub/x.log":    "foo\n",
+		"build/c.txt":  "foo\n",
+		".git/config":  "foo",
+		"bin.dat":      "foo\x00",
+	} {
+		p, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := string(p); s != want {
+			t.Fatalf("%s: have: %q\nwant: %q\n", name, s, want)
+		}
+	}
+	if !strings.Contains(diff.String(), "-foo bar\n+baz bar\n") {
+		t.Fatalf("bad diff:\n%s", diff)
+	}
+
+	sum, err = Apply(MustCompile(",x/bar/ d"), []string{filepath.Join(dir, "sub", "*.txt")}, &ApplyOptions{DryRun: true})
+	if err != nil || sum.Changed != 1 {
+		t.Fatalf("dry run: %v %+v", err, sum)
+	}
+	if p, _ := ioutil.ReadFile(filepath.Join(dir, "sub", "b.txt")); string(p) != "baz bar\n" {
+		t.Fatalf("dry run changed the file: %q", p)
+	}
+
+	// Each file runs the program compiled with its own origin
+	sum, err = Apply(MustCompile(",> $%.bak\n,> copy"), []string{filepath.Join(dir, "sub", "b.txt")}, nil)
+	if err != nil || sum.Changed != 0 {
+		t.Fatalf("origin: %v %+v", err, sum)
+	}
+	for _, name := range []string{"b.txt.bak", "copy"} {
+		if p, _ := ioutil.ReadFile(filepath.Join(dir, "sub", name)); string(p) != "baz bar\n" {
+			t.Fatalf("%s: have: %q\nwant: %q\n", name, p, "baz bar\n")
+		}
+	}
+	cmd, err := Compile(",x/baz/ c/a/\n,x/a/ c/b/", &Options{PerLine: true})
+	if err != nil {
+		t.Fatalf("failed: %s\n", err)
+	}
+	sum, err = Apply(cmd, []string{filepath.Join(dir, "sub", "b.txt")}, nil)
+	if p, _ := ioutil.ReadFile(filepath.Join(dir, "sub", "b.txt")); err != nil || string(p) != "b bbr\n" {
+		t.Fatalf("per line: have: %q %v\nwant: %q\n", p, err, "b bbr\n")
+	}
+
+	name := filepath.Join(dir, "a.txt")
+	ioutil.WriteFile(name, []byte("a b a\n"), 0666)
+	confirm := func(_ string, _ Editor, h *Hunk) (bool, error) { return h.Q0 != 0, nil }
+	if _, err = Apply(MustCompile(",x/a/ c/z/"), []string{name}, &ApplyOptions{Confirm: confirm}); err != nil {
+		t.Fatalf("failed: %s\n", err)
+	}
+	if p, _ := ioutil.ReadFile(name); string(p) != "a b z\n" {
+		t.Fatalf("confirm: have: %q\nwant: %q\n", p, "a b z\n")
+	}
+
+	var fe *FileError
+	_, err = Apply(MustCompile(",d"), []string{filepath.Join(dir, "missing")}, nil)
+	if !errors.As(err, &fe) || fe.Name != filepath.Join(dir, "missing") {
+		t.Fatalf("have %v, want *FileError", err)
+	}
+}
+
+func TestWorkspaceUndo(t *testing.T) {
+	fsys := memFS{fstest.MapFS{}}
+	w := NewWorkspace(&Options{FS: fsys})
+	ed, _ := text.Open(text.NewBuffer())
+	ed.Insert([]byte("one"), 0)
+	f := w.Add("a.go", ed)
+	f.Undo = NewUndo(ed)
+	for i, v := range []struct {
+		prog, want string
+		modified   bool
+	}{
+		{",c/two/", "two", true},
+		{",c/three/", "three", true},
+		{"u", "two", true},
+		{"w", "two", false},
+		{"u -1", "three", true},
+		{",d\nw", "", false},
+	} {
+		if err := w.Run(v.prog); err != nil {
+			t.Fatalf("%d: failed: %s\n", i, err)
+		}
+		if s := string(ed.Bytes()); s != v.want {
+			t.Fatalf("%d: have: %q\nwant: %q\n", i, s, v.want)
+		}
+		if f.Modified != v.modified {
+			t.Fatalf("%d: modified: have %v, want %v", i, f.Modified, v.modified)
+		}
+	}
+	if s := string(fsys.MapFS["a.go"].Data); s != "" {
+		t.Fatalf("written: have %q, want %q", s, "")
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	for i, v := range []struct {
+		prog, in string
+		accept   string // y or n for each hunk
+		hunks    []string
+		want     string
+	}{
+		{",x/a/c/b/", "a1a2a", "yny", []string{`c "a" "b"`, `c "a" "b"`, `c "a" "b"`}, "b1a2b"},
+		{",s/a/b/g", "a1a2a", "nyn", []string{`s "a" "b"`, `s "a" "b"`, `s "a" "b"`}, "a1b2a"},
+		{",x/a+/{\ni/[/\na/]/\n}", "aa b a", "yn", []string{`i "" "["`, `a "" "]"`, `i "" "["`, `a "" "]"`}, "[aa b a"},
+		{",d", "abc", "y", []string{`d "abc" ""`}, ""},
+		{",y/,/c/x/", "a,b", "ny", []string{`c "a" "x"`, `c "b" "x"`}, "a,x"},
+		{",x/nothing/d", "abc", "", nil, "abc"},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			ed, _ := text.Open(text.NewBuffer())
+			ed.Insert([]byte(v.in), 0)
+			cmd, err := Compile(v.prog)
+			if err != nil {
+				t.Fatalf("failed: %s\n", err)
+			}
+			var hunks []string
+			err = cmd.Confirm(ed, func(h *Hunk) (bool, error) {
+				n := len(hunks)
+				hunks = append(hunks, fmt.Sprintf("%s %q %q", h.Cmd, h.Old, h.New))
+				return n < len(v.accept) && v.accept[n] == 'y', nil
+			})
+			if err != nil {
+				t.Fatalf("failed: %s\n", err)
+			}
+			if fmt.Sprint(hunks) != fmt.Sprint(v.hunks) {
+				t.Fatalf("hunks:\nhave: %q\nwant: %q\n", hunks, v.hunks)
+			}
+			if have := string(ed.Bytes()); have != v.want {
+				t.Fatalf("have: %q\nwant: %q\n", have, v.want)
+			}
+		})
+	}
+	t.Run("perline", func(t *testing.T) {
+		ed, _ := text.Open(text.NewBuffer())
+		ed.Insert([]byte("aa"), 0)
+		cmd, err := Compile(",x/a/ c/b/\n,x/b/ c/c/", &Options{PerLine: true})
+		if err != nil {
+			t.Fatalf("failed: %s\n", err)
+		}
+		n := 0
+		err = cmd.Confirm(ed, func(h *Hunk) (bool, error) {
+			n++
+			return n != 2, nil
+		})
+		if err != nil {
+			t.Fatalf("failed: %s\n", err)
+		}
+		if have := string(ed.Bytes()); have != "ca" || n != 3 {
+			t.Fatalf("have: %q after %d hunks\nwant: %q after 3\n", have, n, "ca")
+		}
+	})
+	t.Run("stop", func(t *testing.T) {
+		ed, _ := text.Open(text.NewBuffer())
+		ed.Insert([]byte("abc"), 0)
+		cmd, err := Compile(",x/./ c/z/\n,x/z/ c/y/", &Options{PerLine: true})
+		if err != nil {
+			t.Fatalf("failed: %s\n", err)
+		}
+		n := 0
+		err = cmd.Confirm(ed, func(h *Hunk) (bool, error) {
+			if n++; n == 2 {
+				return false, ErrStop
+			}
+			return true, nil
+		})
+		if err != ErrStop || n != 2 {
+			t.Fatalf("have %v after %d hunks, want %v after 2", err, n, ErrStop)
+		}
+		if have := string(ed.Bytes()); have != "zbc" {
+			t.Fatalf("have: %q\nwant: %q\n", have, "zbc")
+		}
+	})
+	t.Run("abort", func(t *testing.T) {
+		ed, _ := text.Open(text.NewBuffer())
+		ed.Insert([]byte("abc"), 0)
+		stop := errors.New("stop")
+		err := MustCompile(",x/./c/z/").Confirm(ed, func(h *Hunk) (bool, error) {
+			if h.Q0 == 2 {
+				return false, stop
+			}
+			return true, nil
+		})
+		if err != stop {
+			t.Fatalf("have: %v\nwant: %v\n", err, stop)
+		}
+		if have := string(ed.Bytes()); have != "abc" {
+			t.Fatalf("have: %q\nwant: %q\n", have, "abc")
+		}
+		if q0, q1 := ed.Dot(); q0 != 0 || q1 != 0 {
+			t.Fatalf("dot: have #%d,#%d, want #0,#0", q0, q1)
+		}
+	})
+}
@@ -0,0 +1,162 @@
+package edit
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Error is an error from one command in a program
+type Error struct {
+	Cmd string // the command's name, empty for the program's address
+	Pos int    // byte offset of the command in the program
+	N   int    // number of times the command failed
+	Err error  // the first failure
+}
+
+func (e *Error) Error() string {
+	s := fmt.Sprintf("%d: ", e.Pos)
+	if e.Cmd != "" {
+		s += e.Cmd + ": "
+	}
+	s += e.Err.Error()
+	if e.N > 1 {
+		s += fmt.Sprintf(" (%d times)", e.N)
+	}
+	return s
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// Errors lists the commands that failed during a run in
+// the order they appear in the program
+type Errors []*Error
+
+func (e Errors) Error() string {
+	s := make([]string, len(e))
+	for i, err := range e {
+		s[i] = err.Error()
+	}
+	return strings.Join(s, "\n")
+}
+
+func (e Errors) Unwrap() []error {
+	u := make([]error, len(e))
+	for i, err := range e {
+		u[i] = err
+	}
+	return u
+}
+
+// errlist collects the errors from the commands of a
+// running program
+type errlist struct {
+	errs Errors
+}
+
+func (l *errlist) reset() {
+	l.errs = nil
+}
+
+// add records err, which should come from a command wrapped by
+// guard. Repeated failures of the same command are counted.
+func (l *errlist) add(err error) {
+	var e *Error
+	if !errors.As(err, &e) {
+		e = &Error{Pos: -1, Err: err}
+	}
+	for _, v := range l.errs {
+		if v.Pos == e.Pos {
+			v.N++
+			return
+		}
+	}
+	l.errs = append(l.errs, &Error{Cmd: e.Cmd, Pos: e.Pos, N: 1, Err: e.Err})
+}
+
+// result records err and returns the errors collected so far
+func (l *errlist) result(err error) error {
+	if err != nil {
+		l.add(err)
+	}
+	if len(l.errs) == 0 {
+		return nil
+	}
+	sort.SliceStable(l.errs, func(i, j int) bool {
+		return l.errs[i].Pos < l.errs[j].Pos
+	})
+	return l.errs
+}
+
+// guard wraps the errors returned by c in an *Error that
+// records the command and its position. While c runs, it's
+// the current command in o.
+func guard(c *Command, o *owners) {
+	fn := c.fn
+	c.fn = func(f Editor) error {
+		prev := o.cur
+		o.cur = c
+		err := fn(f)
+		o.cur = prev
+		if err == nil {
+			return nil
+		}
+		var e *Error
+		if errors.As(err, &e) {
+			return err
+		}
+		return &Error{Cmd: c.s, Pos: c.pos, Err: err}
+	}
+}
+
+// SyntaxError describes a malformed program
+type SyntaxError struct {
+	Name   string // file containing the program, if any
+	Prog   string // the program
+	Offset int    // byte offset of the error in Prog
+	Line   int    // line number, starting at 1
+	Col    int    // column in runes, starting at 1
+	Kind   Kind   // kind of the offending token
+	Msg    string // description of the error
+}
+
+func newSyntaxError(prog string, tok item, msg string) *SyntaxError {
+	off := tok.pos
+	if off > len(prog) {
+		off = len(prog)
+	}
+	bol := strings.LastIndexByte(prog[:off], '\n') + 1
+	return &SyntaxError{
+		Prog:   prog,
+		Offset: off,
+		Line:   strings.Count(prog[:off], "\n") + 1,
+		Col:    utf8.RuneCountInString(prog[bol:off]) + 1,
+		Kind:   tok.kind,
+		Msg:    msg,
+	}
+}
+
+// Error returns the message followed by the offending line of
+// the program and a caret under the error.
+func (e *SyntaxError) Error() string {
+	bol := strings.LastIndexByte(e.Prog[:e.Offset], '\n') + 1
+	eol := strings.IndexByte(e.Prog[bol:], '\n')
+	if eol == -1 {
+		eol = len(e.Prog)
+	} else {
+		eol += bol
+	}
+	caret := []rune(e.Prog[bol:e.Offset])
+	for i, r := range caret {
+		if r != '\t' {
+			caret[i] = ' '
+		}
+	}
+	pos := fmt.Sprintf("%d:%d", e.Line, e.Col)
+	if e.Name != "" {
+		pos = e.Name + ":" + pos
+	}
+	return fmt.Sprintf("%s: %s\n%s\n%s^", pos, e.Msg, e.Prog[bol:eol], string(caret))
+}
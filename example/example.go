@@ -76,7 +76,7 @@ func main() {
 
 	buf, _ := text.Open(text.BufferFrom(data))
 	if err = cmd.Run(buf); err != nil {
-		log.Fatalln("edit: %s", err)
+		log.Fatalf("edit: %s", err)
 	}
 
 	io.Copy(out, bytes.NewReader(buf.Bytes()))
@@ -0,0 +1,154 @@
+package edit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// DefaultShell is the shell ShellExecutor runs command lines with
+// when its Shell is empty. The command line is its last argument.
+var DefaultShell = []string{"sh", "-c"}
+
+// waitDelay is how long a killed command's output is read
+// before it's abandoned
+const waitDelay = 100 * time.Millisecond
+
+// ErrDryRun is the error of |, < and ! in a dry run, which
+// doesn't run commands
+var ErrDryRun = errors.New("commands don't run in a dry run")
+
+func dryExec(ctx context.Context, line string, stdin []byte) ([]byte, error) {
+	return nil, ErrDryRun
+}
+
+// Executor runs the command lines of |, < and !. Exec runs line
+// with stdin as its standard input, or an empty one if stdin is
+// nil, and returns its standard output. It must stop the command
+// when ctx is done.
+type Executor interface {
+	Exec(ctx context.Context, line string, stdin []byte) ([]byte, error)
+}
+
+// ExecFunc is an Executor that calls itself
+type ExecFunc func(ctx context.Context, line string, stdin []byte) ([]byte, error)
+
+func (f ExecFunc) Exec(ctx context.Context, line string, stdin []byte) ([]byte, error) {
+	return f(ctx, line, stdin)
+}
+
+// ShellExecutor runs command lines through a shell, so they may
+// use its quoting, pipes and redirections. It's the Executor used
+// when Options.Exec is nil.
+type ShellExecutor struct {
+	// Shell is the shell and the flags that make it run its
+	// last argument, such as {"sh", "-c"} or {"rc", "-c"}.
+	// DefaultShell is used if Shell is empty.
+	Shell []string
+
+	// Env is the environment of the command. If nil, the
+	// command inherits the environment of this process.
+	Env []string
+
+	// Dir is the working directory of the command. If empty,
+	// the command runs in the current directory.
+	Dir string
+}
+
+// Exec runs line through the shell. A command that can't be
+// started, or exits with a non-zero status, returns an *ExecError
+// holding what it wrote to its standard error.
+func (s *ShellExecutor) Exec(ctx context.Context, line string, stdin []byte) ([]byte, error) {
+	sh := s.Shell
+	if len(sh) == 0 {
+		sh = DefaultShell
+	}
+	args := append(append([]string{}, sh[1:]...), line)
+	cmd := exec.CommandContext(ctx, sh[0], args...)
+	cmd.Env, cmd.Dir = s.Env, s.Dir
+
+	// Killing the shell doesn't kill the programs it started,
+	// and they may hold on to its output
+	cmd.WaitDelay = waitDelay
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	if err := cmd.Run(); err != nil {
+		return stdout.Bytes(), &ExecError{Line: line, Stderr: stderr.Bytes(), Err: err}
+	}
+	return stdout.Bytes(), nil
+}
+
+// ExecError is returned when a command line fails
+type ExecError struct {
+	Line   string // the command line
+	Stderr []byte // the command's standard error
+	Err    error  // the reason it failed
+}
+
+func (e *ExecError) Error() string {
+	msg := fmt.Sprintf("%s: %s", e.Line, e.Err)
+	if s := strings.TrimSpace(string(e.Stderr)); s != "" {
+		msg += ": " + s
+	}
+	return msg
+}
+
+func (e *ExecError) Unwrap() error {
+	return e.Err
+}
+
+// ExitCode returns the exit status of the command, or -1 if it
+// didn't exit normally
+func (e *ExecError) ExitCode() int {
+	var x *exec.ExitError
+	if errors.As(e.Err, &x) {
+		return x.ExitCode()
+	}
+	return -1
+}
+
+// execOf returns the executor of the run using ed
+func execOf(ed Editor) Executor {
+	if r := runOf(ed); r != nil && r.exec != nil {
+		return r.exec
+	}
+	return &ShellExecutor{}
+}
+
+// shellMeta are the characters that make a shell do more than
+// run one program with literal arguments, unless they are
+// quoted
+const shellMeta = ";&|<>()$`\\\"\n"
+
+// simpleCommand returns the program run by the command line s.
+// It's false unless s runs a single program the same way in sh
+// and rc: outside of single quotes, s can't use shellMeta.
+func simpleCommand(s string) (name string, ok bool) {
+	s = strings.TrimLeft(s, " \t")
+	quoted, end := false, -1
+	for i, c := range s {
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case quoted:
+		case strings.ContainsRune(shellMeta, c):
+			return "", false
+		case (c == ' ' || c == '\t') && end < 0:
+			end = i
+		}
+	}
+	if quoted {
+		return "", false
+	}
+	if end < 0 {
+		end = len(s)
+	}
+	return strings.Replace(s[:end], "'", "", -1), true
+}
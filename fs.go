@@ -0,0 +1,162 @@
+package edit
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// FS is a file system for the commands that read and write
+// files. Reading is done through fs.FS, and WriteFile extends it
+// for w and >.
+type FS interface {
+	fs.FS
+
+	// WriteFile replaces the contents of the named file with
+	// p, creating the file if necessary
+	WriteFile(name string, p []byte) error
+}
+
+// osFS is the file system of the operating system. Unlike most
+// implementations of fs.FS, it accepts rooted and OS-specific
+// names.
+type osFS struct {
+	backup string // if set, keep the old contents of a file in name+backup
+	sync   bool   // flush a file to disk before it replaces the old one
+}
+
+func (osFS) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+func (osFS) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(name)
+}
+
+// WriteFile replaces the named file with one holding p. The new
+// file is written next to the old one and renamed over it, so a
+// failed write leaves the old file intact. It keeps the old file's
+// mode, and a symbolic link is replaced by writing the file it
+// points to. Anything but a regular file, such as a device, is
+// written in place.
+func (o osFS) WriteFile(name string, p []byte) (err error) {
+	fi, err := os.Stat(name)
+	created := false
+	if os.IsNotExist(err) {
+		// Creating the file gives it the mode os.Create would,
+		// and the write replaces it
+		var fd *os.File
+		if fd, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666); err != nil {
+			return err
+		}
+		fd.Close()
+		created = true
+		defer func() {
+			if err != nil {
+				os.Remove(name)
+			}
+		}()
+		fi, err = os.Stat(name)
+	}
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return writeInPlace(name, p)
+	}
+	if name, err = filepath.EvalSymlinks(name); err != nil {
+		return err
+	}
+	if o.backup != "" && !created {
+		if err := backup(name, name+o.backup, fi.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+
+	dir, base := filepath.Split(name)
+	if dir == "" {
+		// An empty dir would put the temporary file in
+		// os.TempDir, which may be on another file system
+		dir = "."
+	}
+	fd, err := ioutil.TempFile(dir, "."+base+".*")
+	if err != nil {
+		return err
+	}
+	tmp := fd.Name()
+	defer os.Remove(tmp)
+	_, err = fd.Write(p)
+	if err == nil {
+		err = fd.Chmod(fi.Mode().Perm())
+	}
+	if err == nil && o.sync {
+		err = fd.Sync()
+	}
+	if err2 := fd.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, name); err != nil {
+		return err
+	}
+	if o.sync {
+		syncDir(dir)
+	}
+	return nil
+}
+
+// backup links or copies the named file to bak
+func backup(name, bak string, mode os.FileMode) error {
+	if err := os.Remove(bak); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if os.Link(name, bak) == nil {
+		return nil
+	}
+	p, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(bak, p, mode)
+}
+
+// writeInPlace truncates the named file and writes p to it
+func writeInPlace(name string, p []byte) error {
+	fd, err := os.OpenFile(name, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fd, bytes.NewReader(p))
+	if err2 := fd.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// syncDir flushes the directory entries of dir to disk. Not every
+// system can sync a directory, so errors are ignored.
+func syncDir(dir string) {
+	if fd, err := os.Open(dir); err == nil {
+		fd.Sync()
+		fd.Close()
+	}
+}
+
+// dryFS is the file system of a dry run. Files are read as
+// usual, but writes are discarded.
+type dryFS struct{ FS }
+
+func (dryFS) WriteFile(name string, p []byte) error { return nil }
+
+// fsOf returns the file system of the run using ed
+func fsOf(ed Editor) FS {
+	if r := runOf(ed); r != nil && r.fs != nil {
+		return r.fs
+	}
+	return osFS{}
+}
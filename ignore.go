@@ -0,0 +1,207 @@
+package edit
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ignorer decides which paths are excluded by .gitignore files.
+// It understands the common subset of the format: comments,
+// negation with !, directory patterns ending in a slash, patterns
+// anchored by a slash, and the wildcards *, ?, [...] and **.
+type ignorer struct {
+	rules map[string][]ignoreRule // the rules in each directory
+	roots map[string]string       // the repository holding each directory
+}
+
+// ignoreRule is one line of a .gitignore file
+type ignoreRule struct {
+	re       *regexp.Regexp
+	negate   bool // the line started with !
+	dirOnly  bool // the line ended with a slash
+	anchored bool // the pattern is matched against the whole path
+}
+
+func newIgnorer() *ignorer {
+	return &ignorer{
+		rules: make(map[string][]ignoreRule),
+		roots: make(map[string]string),
+	}
+}
+
+// ignored reports whether the named file, or one of the
+// directories above it, is ignored. The rules are read from
+// the .gitignore files from the top of the repository holding
+// the file down to the file's directory.
+func (g *ignorer) ignored(name string, dir bool) bool {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return false
+	}
+	top, ok := g.roots[filepath.Dir(abs)]
+	if !ok {
+		top = repoRoot(filepath.Dir(abs))
+		g.roots[filepath.Dir(abs)] = top
+	}
+	var path []string
+	for d := abs; d != top; {
+		path = append(path, d)
+		up := filepath.Dir(d)
+		if up == d {
+			break
+		}
+		d = up
+	}
+	for i := len(path) - 1; i > 0; i-- {
+		if g.match(top, path[i], true) {
+			return true
+		}
+	}
+	return g.match(top, abs, dir)
+}
+
+// match reports whether the rules in the directories from top down
+// to the parent of name ignore name itself. Later and deeper rules
+// take precedence.
+func (g *ignorer) match(top, name string, dir bool) bool {
+	if filepath.Base(name) == ".git" {
+		return true
+	}
+	var dirs []string
+	for d := filepath.Dir(name); ; d = filepath.Dir(d) {
+		dirs = append(dirs, d)
+		if d == top || d == filepath.Dir(d) {
+			break
+		}
+	}
+	ignored := false
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rel, err := filepath.Rel(dirs[i], name)
+		if err != nil {
+			continue
+		}
+		for _, r := range g.load(dirs[i]) {
+			if r.match(filepath.ToSlash(rel), dir) {
+				ignored = !r.negate
+			}
+		}
+	}
+	return ignored
+}
+
+// load returns the rules in dir's .gitignore file
+func (g *ignorer) load(dir string) []ignoreRule {
+	if r, ok := g.rules[dir]; ok {
+		return r
+	}
+	var rules []ignoreRule
+	data, err := ioutil.ReadFile(filepath.Join(dir, ".gitignore"))
+	if err == nil {
+		sc := bufio.NewScanner(bytes.NewReader(data))
+		for sc.Scan() {
+			if r, ok := parseIgnoreRule(sc.Text()); ok {
+				rules = append(rules, r)
+			}
+		}
+	}
+	g.rules[dir] = rules
+	return rules
+}
+
+// match reports whether the rule matches the path rel, relative
+// to the rule's directory
+func (r ignoreRule) match(rel string, dir bool) bool {
+	if r.dirOnly && !dir {
+		return false
+	}
+	if !r.anchored {
+		rel = rel[strings.LastIndexByte(rel, '/')+1:]
+	}
+	return r.re.MatchString(rel)
+}
+
+// parseIgnoreRule parses a line of a .gitignore file. It returns
+// false for blank lines and comments.
+func parseIgnoreRule(s string) (r ignoreRule, ok bool) {
+	s = strings.TrimRight(s, " \t\r")
+	if s == "" || s[0] == '#' {
+		return r, false
+	}
+	if s[0] == '!' {
+		r.negate, s = true, s[1:]
+	} else if s[0] == '\\' && len(s) > 1 {
+		s = s[1:]
+	}
+	if strings.HasSuffix(s, "/") {
+		r.dirOnly, s = true, strings.TrimRight(s, "/")
+	}
+	if strings.Contains(s, "/") {
+		r.anchored, s = true, strings.TrimPrefix(s, "/")
+	}
+	if s == "" {
+		return r, false
+	}
+	re, err := regexp.Compile("^" + globRegexp(s) + "$")
+	if err != nil {
+		return r, false
+	}
+	r.re = re
+	return r, true
+}
+
+// globRegexp translates a gitignore glob to a regular expression
+func globRegexp(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case strings.HasPrefix(s[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(s[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			j := strings.IndexByte(s[i+1:], ']')
+			if j < 0 {
+				b.WriteString(`\[`)
+				break
+			}
+			class := s[i+1 : i+1+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += j + 1
+		case c == '\\' && i+1 < len(s):
+			i++
+			b.WriteString(regexp.QuoteMeta(s[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(s[i : i+1]))
+		}
+	}
+	return b.String()
+}
+
+// repoRoot returns the top of the repository holding dir, or dir
+// if it isn't in one
+func repoRoot(dir string) string {
+	for d := dir; ; {
+		if _, err := os.Stat(filepath.Join(d, ".git")); err == nil {
+			return d
+		}
+		up := filepath.Dir(d)
+		if up == d {
+			return dir
+		}
+		d = up
+	}
+}
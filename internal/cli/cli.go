@@ -0,0 +1,69 @@
+// Package cli holds what the edit commands share: the program
+// given by their -e and -f flags, and a Sender that prints the
+// output of p, = and !.
+package cli
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Program is the program given by -e and -f, a line per flag
+type Program []string
+
+func (p *Program) String() string {
+	if p == nil {
+		return ""
+	}
+	return strings.Join(*p, "\n")
+}
+
+// Expr returns the flag.Value for -e, which adds its argument
+// to the program
+func (p *Program) Expr() flag.Value { return expr{p} }
+
+// Script returns the flag.Value for -f, which adds the contents
+// of the named file to the program
+func (p *Program) Script() flag.Value { return script{p} }
+
+type expr struct{ *Program }
+
+func (e expr) Set(s string) error {
+	*e.Program = append(*e.Program, s)
+	return nil
+}
+
+type script struct{ *Program }
+
+func (s script) Set(name string) error {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	*s.Program = append(*s.Program, strings.TrimSuffix(string(data), "\n"))
+	return nil
+}
+
+// Printer is a Sender that prints each message on its own line.
+// Empty messages, such as p of an empty dot, aren't printed.
+type Printer struct {
+	W *bufio.Writer
+}
+
+func (p Printer) Send(e interface{}) {
+	s := fmt.Sprint(e)
+	if s == "" {
+		return
+	}
+	p.W.WriteString(s)
+	if !strings.HasSuffix(s, "\n") {
+		p.W.WriteByte('\n')
+	}
+}
+
+func (p Printer) SendFirst(e interface{}) {
+	p.Send(e)
+}
@@ -12,6 +12,7 @@ import (
 type item struct {
 	kind  Kind
 	value string
+	pos   int // byte offset in the input
 }
 
 func (i item) String() string {
@@ -20,19 +21,26 @@ func (i item) String() string {
 
 const (
 	ralpha  = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ="
-	rcmd    = ralpha + "<>|"
+	rcmd    = ralpha + "<>|!{"
 	rdigit  = "0123456789"
+	rnoarg  = "dpn="
+	rfile   = "erw"
+	rnames  = "bBDf"
+	rregexp = "xygv"
 	rop     = "+-;,"
-	rmod    = "^$#/?"
+	rmod    = "^$#/?'"
+	raddr   = rdigit + rop + rmod + "." // the start of an address
+	rlower  = "abcdefghijklmnopqrstuvwxyz"
 	rescape = `#/?+-;,\abnrtx`
 )
 
-const maxBytes = ^uint64(0)
+const maxBytes = 1<<63 - 1
 
 func max() string {
 	return fmt.Sprintf("%v", maxBytes)
 }
 
+// Kind is the kind of a token in a program
 type Kind int
 
 const (
@@ -56,7 +64,46 @@ const (
 	kindCount
 	kindCmd
 	kindArg
+	kindLBrace
+	kindRBrace
+	kindMark
+	kindNewline
 )
+
+var kindNames = [...]string{
+	kindOp:         "operator",
+	kindString:     "string",
+	kindSlash:      "slash",
+	kindQuest:      "question mark",
+	kindRel:        "relative address",
+	kindComma:      "comma",
+	kindDot:        "dot",
+	kindEof:        "end of program",
+	kindColon:      "colon",
+	kindSemi:       "semicolon",
+	kindHash:       "hash",
+	kindErr:        "error",
+	kindGlobal:     "global suffix",
+	kindRegexp:     "regexp",
+	kindRegexpBack: "backward regexp",
+	kindByteOffset: "byte address",
+	kindLineOffset: "line address",
+	kindCount:      "count",
+	kindCmd:        "command",
+	kindArg:        "argument",
+	kindLBrace:     "{",
+	kindRBrace:     "}",
+	kindMark:       "mark",
+	kindNewline:    "newline",
+}
+
+func (k Kind) String() string {
+	if k < 0 || int(k) >= len(kindNames) {
+		return fmt.Sprintf("Kind(%d)", int(k))
+	}
+	return kindNames[k]
+}
+
 const (
 	eof    = '\x00'
 	slash  = '/'
@@ -69,6 +116,7 @@ const (
 	hash   = '#'
 	dollar = '$'
 	caret  = '^'
+	quote  = '\''
 )
 
 type statefn func(*lexer) statefn
@@ -83,6 +131,7 @@ type lexer struct {
 	lastop item
 	first  bool
 	esc    bool
+	depth  int
 }
 
 func lex(name, input string) (*lexer, chan item) {
@@ -90,7 +139,7 @@ func lex(name, input string) (*lexer, chan item) {
 		name:   name,
 		input:  input,
 		items:  make(chan item),
-		lastop: item{kindOp, "+"},
+		lastop: item{kind: kindOp, value: "+"},
 		first:  true,
 	}
 	go l.run() // run state machine
@@ -118,31 +167,27 @@ func (l *lexer) acceptRun(valid string) {
 	l.backup()
 }
 
+// acceptUntil accepts everything up to the first delimiter
+// not escaped by a backslash, or the end of the input
 func (l *lexer) acceptUntil(delim string) {
-	lim := 8192
-	i := 0
-	for !strings.ContainsRune(delim, l.next()) {
-		i++
-		if i > lim {
-			l.errorf("missing terminating char %q: %q\n", delim, l)
-			l.ignore()
-			l.emit(kindEof)
+	for {
+		switch r := l.next(); {
+		case r == eof:
+			return
+		case r == '\\':
+			l.next()
+		case strings.ContainsRune(delim, r):
+			l.backup()
 			return
 		}
 	}
-	l.backup()
 }
 
-func (l *lexer) acceptEOF() {
-	lim := 8192
-	i := 0
-	for l.next() != eof {
-		i++
-		if i > lim {
-			l.emit(kindEof)
-			return
-		}
+// acceptLine accepts everything up to the next newline
+func (l *lexer) acceptLine() {
+	for r := l.next(); r != '\n' && r != eof; r = l.next() {
 	}
+	l.backup()
 }
 
 func (l *lexer) backup() {
@@ -150,15 +195,73 @@ func (l *lexer) backup() {
 }
 
 func (l *lexer) emit(t Kind) {
-	s, err := strconv.Unquote(`"` + l.String() + `"`)
-	if err != nil {
-		l.errorf(err.Error())
+	l.emitValue(t, l.unquote(l.String()))
+}
+
+// emitRaw is like emit, but doesn't interpret escape sequences
+func (l *lexer) emitRaw(t Kind) {
+	l.emitValue(t, l.String())
+}
+
+// emitDelimited emits an argument ended by delim. The backslashes
+// escaping the delimiter are removed and, unless raw is set, the
+// other escape sequences are interpreted.
+func (l *lexer) emitDelimited(t Kind, delim string, raw bool) {
+	s := unescape(l.String(), delim)
+	if !raw {
+		s = l.unquote(s)
 	}
-	l.items <- item{t, s}
+	l.emitValue(t, s)
+}
+
+func (l *lexer) emitValue(t Kind, s string) {
+	l.items <- item{t, s, l.start}
 	l.start = l.pos
 }
 
+// unquote interprets the Go escape sequences in s
+func (l *lexer) unquote(s string) string {
+	b := make([]byte, 0, len(s))
+	for in := s; in != ""; {
+		if in[0] == '"' {
+			b, in = append(b, '"'), in[1:]
+			continue
+		}
+		r, multi, tail, err := strconv.UnquoteChar(in, '"')
+		if err != nil {
+			l.errorf("bad escape sequence in %q", s)
+			return ""
+		}
+		if multi {
+			b = append(b, string(r)...)
+		} else {
+			b = append(b, byte(r))
+		}
+		in = tail
+	}
+	return string(b)
+}
+
+// unescape removes the backslashes escaping delim in s
+func unescape(s, delim string) string {
+	if !strings.Contains(s, `\`+delim) {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			if !strings.HasPrefix(s[i+1:], delim) {
+				b = append(b, s[i])
+			}
+			i++
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
 func (l *lexer) inject(it item) {
+	it.pos = l.start
 	l.items <- it
 }
 
@@ -197,9 +300,44 @@ func ignoreSpaces(l *lexer) {
 	}
 }
 
+// ignoreLines skips blanks, newlines and comments
+func ignoreLines(l *lexer) {
+	for {
+		l.acceptRun(" \t\n")
+		l.ignore()
+		if !l.comment(true) {
+			return
+		}
+	}
+}
+
+// comment skips a comment, which starts with a # and runs until
+// the end of the line. It reports whether there was one. Where
+// an address may follow, a # followed by a digit, after any
+// blanks, is a byte address instead.
+func (l *lexer) comment(addr bool) bool {
+	in := l.input[l.pos:]
+	if !strings.HasPrefix(in, "#") {
+		return false
+	}
+	if in = strings.TrimLeft(in[1:], " \t"); addr && in != "" && strings.IndexByte(rdigit, in[0]) >= 0 {
+		return false
+	}
+	l.acceptLine()
+	l.ignore()
+	return true
+}
+
+// lexAny lexes the start of a line
 func lexAny(l *lexer) statefn {
-	ignoreSpaces(l)
-	if l.accept(rdigit + rop + rmod) {
+	ignoreLines(l)
+	if l.peek() == eof {
+		l.emit(kindEof)
+		return nil
+	}
+	l.first = true
+	l.lastop = item{kind: kindOp, value: "+"}
+	if l.accept(raddr) {
 		l.backup()
 		return lexAddr
 	}
@@ -217,7 +355,7 @@ func lexAddr(l *lexer) statefn {
 	case ',', ';':
 		// LHS is empty so use #0
 		if l.first {
-			l.inject(item{kindByteOffset, "0"})
+			l.inject(item{kind: kindByteOffset, value: "0"})
 			l.first = false
 		}
 		return lexOp
@@ -234,6 +372,12 @@ func lexAddr(l *lexer) statefn {
 		l.accept(".")
 		l.emit(kindDot)
 		return lexOp
+	case quote:
+		l.accept("'")
+		l.ignore()
+		l.accept(rlower)
+		l.emit(kindMark)
+		return lexOp
 	case hash:
 		l.accept("#")
 		l.ignore()
@@ -247,12 +391,12 @@ func lexAddr(l *lexer) statefn {
 	default:
 		if l.accept("$") {
 			l.ignore()
-			l.inject(item{kindByteOffset, max()})
+			l.inject(item{kind: kindByteOffset, value: max()})
 			return lexCmd
 		}
 		if l.accept("^") {
 			l.ignore()
-			l.inject(item{kindByteOffset, "0"})
+			l.inject(item{kind: kindByteOffset, value: "0"})
 			return lexOp
 		}
 		if l.accept(rdigit) {
@@ -264,6 +408,26 @@ func lexAddr(l *lexer) statefn {
 	return lexCmd
 }
 
+// lexBlock lexes the start of a command inside braces. Unlike lexAny
+// it doesn't emit an implicit dot when the address is missing.
+func lexBlock(l *lexer) statefn {
+	ignoreLines(l)
+	l.first = true
+	if l.accept(raddr) {
+		l.backup()
+		return lexAddr
+	}
+	return lexCmd
+}
+
+// endCmd returns the state following a complete command
+func (l *lexer) endCmd() statefn {
+	if l.depth > 0 {
+		return lexBlock
+	}
+	return lexCmd
+}
+
 func lexArgsTuple(l *lexer) statefn {
 	if !l.accept("s") {
 		return l.errorf("want 's', have %q", l.String())
@@ -279,50 +443,156 @@ func lexArgsTuple(l *lexer) statefn {
 	l.ignore()
 
 	l.acceptUntil(r)
-	l.emit(kindArg)
+	l.emitDelimited(kindArg, r, true)
 	if !l.accept(r) {
 		return l.errorf("bad opening delimiter: %q", r)
 	}
 	l.ignore()
 	l.acceptUntil(r)
-	l.emit(kindArg)
+	l.emitDelimited(kindArg, r, true) // escapes are handled by compileReplaceAmp
 	if !l.accept(r) {
 		return l.errorf("bad closing delimiter: %q", r)
 	}
 	l.ignore()
 	ignoreSpaces(l)
-	if l.accept("g") {
-		l.emit(kindGlobal)
-	}
-	return lexCmd
+	l.accept("g")
+	l.emit(kindGlobal) // always emitted, so the parser can't overshoot
+	return l.endCmd()
 }
 
 func lexCmd(l *lexer) statefn {
 	ignoreSpaces(l)
+	if l.peek() == ',' {
+		if in := strings.TrimLeft(l.input[l.pos+1:], " \t"); in == "" || in[0] == '\n' {
+			// A comma ending a line after a command was ignored
+			// before syntax errors were reported, so it still is
+			l.accept(",")
+			l.ignore()
+			ignoreSpaces(l)
+		}
+	}
+	l.comment(false)
 	if l.peek() == eof {
 		l.emit(kindEof)
 		return nil
 	}
+	if l.peek() == '\n' {
+		if l.depth > 0 {
+			return lexBlock
+		}
+		l.accept("\n")
+		l.emitRaw(kindNewline)
+		return lexAny
+	}
 	if l.peek() == 's' {
 		return lexArgsTuple
 	}
+	if l.accept("{") {
+		l.emit(kindLBrace)
+		l.depth++
+		return lexBlock
+	}
+	if l.accept("}") {
+		if l.depth == 0 {
+			return l.errorf("unexpected }")
+		}
+		l.emit(kindRBrace)
+		l.depth--
+		return l.endCmd()
+	}
 	if !l.accept(ralpha) {
-		if l.accept("|<>") {
+		if l.accept("|<>!") {
 			l.emit(kindCmd)
 			return lexArg2
 		}
-		return l.errorf("bad command")
+		return l.errorf("bad command %q", l.peek())
 	}
+	cmd := l.String()
 	l.emit(kindCmd)
-	switch l.peek() {
-	case eof:
+	switch {
+	case strings.Contains(rnoarg, cmd):
+		return l.endCmd()
+	case cmd == "k":
+		return lexMark
+	case cmd == "u":
+		return lexUndo
+	case cmd == "m" || cmd == "t":
+		return lexTarget
+	case strings.Contains(rnames, cmd):
+		return lexFile
+	case strings.Contains(rfile, cmd) && (l.peek() == eof || l.peek() == '\n'):
+		l.emit(kindArg)
+		return l.endCmd()
+	case cmd == "X" || cmd == "Y":
+		return lexFiles
+	case l.peek() == eof:
 		l.emit(kindEof)
 		return nil
+	case strings.Contains("aic", cmd) && l.peek() == '\n':
+		return lexText
+	case strings.Contains(rregexp, cmd):
+		return lexArgRegexp
+	case strings.Contains(rfile, cmd) && strings.ContainsRune(" \t", l.peek()):
+		return lexFile
 	default:
 		return lexArg
 	}
 }
 
+// lexFiles lexes the optional regexp following X or Y, which is
+// always emitted, and the command run in each file. Unlike
+// the command following x, it may have an address.
+func lexFiles(l *lexer) statefn {
+	if l.peek() == '/' {
+		if lexArgRegexp(l) == nil {
+			return nil
+		}
+	} else {
+		l.emit(kindArg)
+	}
+	ignoreSpaces(l)
+	l.first = true
+	l.lastop = item{kind: kindOp, value: "+"}
+	if l.accept(raddr) {
+		l.backup()
+		return lexAddr
+	}
+	return lexCmd
+}
+
+// lexMark lexes the optional name following k, which may be
+// separated from it by blanks. The name is always emitted, even
+// if it's empty.
+func lexMark(l *lexer) statefn {
+	ignoreSpaces(l)
+	if l.accept(rlower) {
+		if r := l.peek(); unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return l.errorf("bad mark name")
+		}
+	} else if unicode.IsLetter(l.peek()) {
+		return l.errorf("bad mark name")
+	}
+	l.emit(kindArg)
+	return l.endCmd()
+}
+
+// lexTarget lexes the address following m or t
+func lexTarget(l *lexer) statefn {
+	ignoreSpaces(l)
+	l.first = true
+	return lexAddr
+}
+
+// lexUndo lexes the optional, possibly negative, count
+// following u. The count is always emitted.
+func lexUndo(l *lexer) statefn {
+	ignoreSpaces(l)
+	l.accept("-")
+	l.acceptRun(rdigit)
+	l.emit(kindArg)
+	return l.endCmd()
+}
+
 func lexOp(l *lexer) statefn {
 	ignoreSpaces(l)
 	tok := l.peek()
@@ -332,7 +602,7 @@ func lexOp(l *lexer) statefn {
 	}
 	if tok == dollar {
 		l.ignore()
-		l.inject(item{kindByteOffset, max()})
+		l.inject(item{kind: kindByteOffset, value: max()})
 		return lexAddr
 	}
 	op := ""
@@ -346,32 +616,86 @@ func lexOp(l *lexer) statefn {
 			l.inject(l.lastop)
 		}
 		l.backup()
-		l.lastop = item{kindOp, op}
+		l.lastop = item{kind: kindOp, value: op}
 	}
-	// use rcmd to det. whether closing addr is injected
-	if tok := l.peek(); op != "" && (l.accept(rcmd) || tok == eof) {
-		l.inject(item{kindByteOffset, max()})
-		l.backup()
+	// use rcmd to det. whether closing addr is injected. Like
+	// sam, a missing address after + or - is one line.
+	if tok := l.peek(); op != "" && (strings.ContainsRune(rcmd, tok) || tok == eof || tok == '\n') {
+		if op == "+" || op == "-" {
+			l.inject(item{kind: kindLineOffset, value: "1"})
+		} else {
+			l.inject(item{kind: kindByteOffset, value: max()})
+		}
 	}
 	return lexAddr
 }
 
 func lexArg(l *lexer) statefn {
+	return lexDelimited(l, false)
+}
+
+// lexArgRegexp is like lexArg, but leaves the escape sequences
+// in the argument for the regexp compiler
+func lexArgRegexp(l *lexer) statefn {
+	return lexDelimited(l, true)
+}
+
+func lexDelimited(l *lexer, raw bool) statefn {
 	r := string(l.next())
 	l.ignore()
 	l.acceptUntil(r)
-	l.emit(kindArg)
-	if !l.accept(string(r)) {
+	l.emitDelimited(kindArg, r, raw)
+	if !l.accept(r) {
 		return l.errorf("bad delimiter")
 	}
 	l.ignore()
-	return lexCmd
+	return l.endCmd()
+}
+
+// lexText lexes the text of a, i or c given on the lines after
+// the command. The text ends with a line holding only a period
+// and is taken literally.
+func lexText(l *lexer) statefn {
+	l.accept("\n")
+	l.ignore()
+	in := l.input[l.pos:]
+	n := 0
+	for {
+		eol := strings.IndexByte(in[n:], '\n')
+		if eol == -1 {
+			eol = len(in) - n
+		}
+		if in[n:n+eol] == "." {
+			break
+		}
+		if n+eol == len(in) {
+			return l.errorf("missing terminating line \".\"")
+		}
+		n += eol + 1
+	}
+	l.pos += n
+	l.emitRaw(kindArg)
+	l.accept(".")
+	l.ignore()
+	return l.endCmd()
 }
 
+// lexFile lexes a file name separated from its command by
+// blanks. The name, or list of names, runs until the end of
+// the line and may be empty.
+func lexFile(l *lexer) statefn {
+	ignoreSpaces(l)
+	l.acceptLine()
+	l.emit(kindArg)
+	return l.endCmd()
+}
+
+// lexArg2 lexes the argument of |, <, > and !, which runs
+// until the end of the line
 func lexArg2(l *lexer) statefn {
-	l.acceptEOF()
+	l.acceptLine()
 	l.emit(kindArg)
-	return lexCmd
+	return l.endCmd()
 }
 
 func lexRegexp(l *lexer) statefn {
@@ -382,9 +706,9 @@ func lexRegexp(l *lexer) statefn {
 	l.ignore()
 	l.acceptUntil(string(rune(r)))
 	if r == '?' {
-		l.emit(kindRegexpBack)
+		l.emitDelimited(kindRegexpBack, "?", true)
 	} else {
-		l.emit(kindRegexp)
+		l.emitDelimited(kindRegexp, "/", true)
 	}
 	if !l.accept(string(rune(r))) {
 		return l.errorf("bad regexp terminator: %q", l)
@@ -397,6 +721,7 @@ func (l *lexer) errorf(format string, args ...interface{}) statefn {
 	l.items <- item{
 		kindErr,
 		fmt.Sprintf(format, args...),
+		l.start,
 	}
 	return nil
 }
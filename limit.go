@@ -0,0 +1,75 @@
+package edit
+
+import (
+	"fmt"
+	"time"
+)
+
+// Limits bounds the work done by one run of a program. A zero
+// field means no limit. A run that exceeds a limit fails with a
+// *LimitError and commits nothing.
+//
+// The limits count the work of the whole run. With
+// Options.PerLine, the lines before the one that exceeds a limit
+// have already been committed, and they keep their changes.
+type Limits struct {
+	Loops   int64         // iterations of the x and y loops, in total
+	Matches int64         // replacements made by one s command
+	Insert  int64         // bytes inserted or written over, in total
+	Output  int64         // bytes sent by p and =, in total
+	Runtime time.Duration // running time of each subprocess
+}
+
+// LimitError is returned when a run exceeds one of its Limits
+type LimitError struct {
+	Limit string // name of the field in Limits
+	Max   int64  // the limit's value
+}
+
+func (e *LimitError) Error() string {
+	if e.Limit == "Runtime" {
+		return fmt.Sprintf("limit exceeded: %s %s", e.Limit, time.Duration(e.Max))
+	}
+	return fmt.Sprintf("limit exceeded: %s %d", e.Limit, e.Max)
+}
+
+// budget counts the work done by a run against its limits. The
+// first limit exceeded is kept in err.
+type budget struct {
+	Limits
+	loops, inserted, output int64
+	err                     error
+}
+
+func (b *budget) reset() {
+	b.loops, b.inserted, b.output, b.err = 0, 0, 0, nil
+}
+
+// spend adds n to *have and fails if that exceeds max
+func (b *budget) spend(have *int64, n, max int64, name string) error {
+	*have += n
+	if max > 0 && *have > max && b.err == nil {
+		b.err = &LimitError{Limit: name, Max: max}
+	}
+	return b.err
+}
+
+// loop counts one iteration of an x or y loop
+func (b *budget) loop() error {
+	return b.spend(&b.loops, 1, b.Loops, "Loops")
+}
+
+// insert counts n bytes inserted or written
+func (b *budget) insert(n int) error {
+	return b.spend(&b.inserted, int64(n), b.Insert, "Insert")
+}
+
+// print counts n bytes of output
+func (b *budget) print(n int) error {
+	return b.spend(&b.output, int64(n), b.Output, "Output")
+}
+
+// match fails if n replacements exceed the limit for one s
+func (b *budget) match(n int64) error {
+	return b.spend(&n, 0, b.Matches, "Matches")
+}
@@ -0,0 +1,99 @@
+package edit
+
+import "fmt"
+
+// Marks holds the marks set by the k command, indexed by name.
+// The unnamed mark, set by a bare k, is named by a quote.
+type Marks map[byte]Dot
+
+// Marker is implemented by Editors that keep their own marks.
+// A Command keeps the marks for Editors that don't implement it,
+// so those marks only live as long as the Command does, and a
+// Workspace keeps them for each of its files.
+type Marker interface {
+	Marks() Marks
+}
+
+// Mark is an address computed from a mark set by k
+type Mark struct {
+	Name  byte
+	marks *Marks
+}
+
+func (m Mark) Back() bool { return false }
+
+func (m *Mark) Set(f Editor) error {
+	d, ok := (*m.marks)[m.Name]
+	if !ok {
+		return fmt.Errorf("no mark %q", m.Name)
+	}
+	n := f.Len()
+	if d.Q1 > n {
+		d.Q1 = n
+	}
+	if d.Q0 > d.Q1 {
+		d.Q0 = d.Q1
+	}
+	f.Select(d.Q0, d.Q1)
+	return nil
+}
+
+// marksOf returns the marks stored by ed, or own if ed
+// doesn't store any
+func marksOf(ed Editor, own Marks) Marks {
+	if m, ok := ed.(Marker); ok {
+		if marks := m.Marks(); marks != nil {
+			return marks
+		}
+	}
+	return own
+}
+
+// clone returns a copy of the marks
+func (m Marks) clone() Marks {
+	c := make(Marks, len(m))
+	for k, d := range m {
+		c[k] = d
+	}
+	return c
+}
+
+// restore replaces the marks with those in c
+func (m Marks) restore(c Marks) {
+	for k := range m {
+		delete(m, k)
+	}
+	for k, d := range c {
+		m[k] = d
+	}
+}
+
+// insert shifts the marks after q0 forward by n bytes
+func (m Marks) insert(q0, n int64) {
+	for k, d := range m {
+		if q0 < d.Q1 {
+			d.Q1 += n
+		}
+		if q0 < d.Q0 {
+			d.Q0 += n
+		}
+		m[k] = d
+	}
+}
+
+// delete shifts the marks after q0 back by the size of the
+// deleted range, collapsing the marks inside it to q0
+func (m Marks) delete(q0, q1 int64) {
+	adj := func(q int64) int64 {
+		if q >= q1 {
+			return q - (q1 - q0)
+		}
+		if q > q0 {
+			return q0
+		}
+		return q
+	}
+	for k, d := range m {
+		m[k] = Dot{adj(d.Q0), adj(d.Q1)}
+	}
+}
@@ -2,9 +2,10 @@ package edit
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
-	"io"
-	"os"
+	"path"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -12,39 +13,65 @@ import (
 
 type Print string
 
-var eprint = n
-
 type Emitted struct {
 	Name string
 	Dot  []Dot
 }
 
+// line is one line of a program: an address and the
+// commands that run on it
+type line struct {
+	addr Address
+	pos  int // byte offset of the address
+	cmd  []*Command
+}
+
 type parser struct {
-	cmd       []*Command
+	prog      string
+	lines     []*line
 	last, tok item
 	in        chan item
 	out       chan func()
 	err       error
 	stop      chan error
-	addr      Address
 
 	recache map[string]*regexp.Regexp
+	cmds    map[int]*Command // the commands by position
 
 	Emit    *Emitted
 	Options *Options
+
+	marks  *Marks
+	errs   *errlist
+	undo   *undoer
+	owners *owners
+	budget *budget
+
+	addressed bool // the command being parsed was given an address
 }
 
-func parse(i chan item, opts ...*Options) *parser {
+func parse(prog string, i chan item, opts ...*Options) *parser {
 	var o *Options
 	if len(opts) != 0 {
 		o = opts[0]
 	}
+	marks := Marks{}
 	p := &parser{
+		prog:    prog,
 		in:      i,
 		stop:    make(chan error),
 		Emit:    &Emitted{},
 		Options: o,
 		recache: make(map[string]*regexp.Regexp),
+		cmds:    make(map[int]*Command),
+		marks:   &marks,
+		errs:    &errlist{},
+		undo:    &undoer{},
+		owners:  &owners{},
+		budget:  &budget{},
+	}
+	if o != nil {
+		p.budget.Limits = o.Limits
 	}
 	go p.run()
 	return p
@@ -80,13 +107,16 @@ func parseOp(p *parser) (op byte, a Address) {
 	}
 	v := p.tok.value
 	if v == "" {
-		eprint("no value" + v)
+		p.fatal(fmt.Errorf("missing address operator"))
 		return
 	}
-	if !strings.ContainsAny(v, "+-;,") {
-		//		eprint(fmt.Sprintf("bad op: %q", v))
-	}
 	p.Next()
+	switch v[0] {
+	case '+':
+		return v[0], parseRelAddr(p, 1)
+	case '-':
+		return v[0], parseRelAddr(p, -1)
+	}
 	return v[0], parseSimpleAddr(p)
 }
 
@@ -106,25 +136,34 @@ func tryRelative(p *parser) int {
 // Put
 func parseSimpleAddr(p *parser) (a Address) {
 	//fmt.Printf("parseSimpleAddr:1 %s\n", p.tok)
-	back := false
-	rel := tryRelative(p)
+	return parseRelAddr(p, tryRelative(p))
+}
+
+// parseRelAddr parses a simple address that is relative to
+// dot in the direction of rel, or absolute if rel is 0
+func parseRelAddr(p *parser, rel int) (a Address) {
 	v := p.tok.value
 	k := p.tok
 	//fmt.Printf("%s\n", k)
 	switch k.kind {
-	case kindRegexpBack:
-		back = true
-		fallthrough
-	case kindRegexp:
+	case kindRegexp, kindRegexpBack:
+		// A minus reverses the direction of the search, so
+		// -/re/ is ?re? and -?re? is /re/
+		back := (k.kind == kindRegexpBack) != (rel == -1)
 		re, err := regexp.Compile(v)
 		if err != nil {
 			p.fatal(err)
 			return
 		}
-		if rel != -1 {
-			rel = 1
+		r := &Regexp{re: re, back: back, rel: 1}
+		if back {
+			r.rel = -1
+			if r.rev, err = reverseRegexp(v); err != nil {
+				p.fatal(err)
+				return
+			}
 		}
-		return &Regexp{re, back, 1}
+		return r
 	case kindLineOffset, kindByteOffset:
 		i := p.mustatoi(v)
 		if rel < 0 {
@@ -136,8 +175,13 @@ func parseSimpleAddr(p *parser) (a Address) {
 		return &Byte{i, rel}
 	case kindDot:
 		return &Dot{}
+	case kindMark:
+		if v == "" {
+			return &Mark{Name: '\'', marks: p.marks}
+		}
+		return &Mark{Name: v[0], marks: p.marks}
 	}
-	p.err = fmt.Errorf("bad address: %q", v)
+	p.fatal(fmt.Errorf("bad address: %q", v))
 	return
 }
 
@@ -153,6 +197,64 @@ func (p *parser) Dot(f Editor) (q0, q1 int64) {
 	return f.Dot()
 }
 
+// loops reports whether c runs the command that follows it
+func loops(c *Command) bool {
+	return strings.Contains("xygvXY", c.s)
+}
+
+// parseBlock parses the commands between braces. The current
+// token is the opening brace. An empty block does nothing.
+func parseBlock(p *parser) (b Block) {
+	b = Block{}
+	for {
+		p.Next()
+		switch p.tok.kind {
+		case kindRBrace:
+			return b
+		case kindEof, kindErr:
+			p.fatal(fmt.Errorf("missing }"))
+			return nil
+		}
+		c := parseElem(p)
+		if c == nil {
+			p.fatal(fmt.Errorf("unknown command %q", p.tok.value))
+			return nil
+		}
+		b = append(b, c.fn)
+	}
+}
+
+// parseElem parses one command inside a block along with its
+// optional address and, if the command loops, the command it runs.
+func parseElem(p *parser) (c *Command) {
+	var a Address
+	if p.tok.kind != kindCmd && p.tok.kind != kindLBrace {
+		a = parseAddr(p)
+	}
+	p.addressed = a != nil
+	c = parseCmd(p)
+	if c == nil || c.fn == nil {
+		return c
+	}
+	defer guard(c, p.owners)
+	if loops(c) {
+		p.Next()
+		if c.next = parseElem(p); c.next == nil {
+			return nil
+		}
+	}
+	if a != nil {
+		fn := c.fn
+		c.fn = func(f Editor) error {
+			if err := a.Set(f); err != nil {
+				return err
+			}
+			return fn(f)
+		}
+	}
+	return c
+}
+
 type Sender interface {
 	Send(e interface{})
 	SendFirst(e interface{})
@@ -163,32 +265,50 @@ func parseCmd(p *parser) (c *Command) {
 	v := p.tok.value
 	c = &Command{}
 	c.s = v
+	c.pos = p.tok.pos
+	p.cmds[c.pos] = c
 	switch v {
+	case "{":
+		b := parseBlock(p)
+		if b == nil {
+			return nil
+		}
+		c.fn = b.Apply
+		return
 	case "h":
 		parseArg(p)
-		c.fn = func(f Editor) {
+		c.fn = func(f Editor) error {
 			q0, q1 := f.Dot()
 			p.Emit.Dot = append(p.Emit.Dot, Dot{q0, q1})
+			return nil
 		}
 		return
 	case "=":
 		if p.Options == nil || p.Options.Sender == nil {
 			return
 		}
-		c.fn = func(f Editor) {
+		c.fn = func(f Editor) error {
 			q0, q1 := f.Dot()
 			str := fmt.Sprintf("%s:#%d,#%d", p.Options.Origin, q0+1, q1)
+			if err := limitsOf(f).print(len(str)); err != nil {
+				return err
+			}
 			p.Options.Sender.Send(Print(str))
+			return nil
 		}
 		return
 	case "p":
 		if p.Options == nil || p.Options.Sender == nil {
 			return
 		}
-		c.fn = func(f Editor) {
+		c.fn = func(f Editor) error {
 			q0, q1 := p.Dot(f)
 			str := fmt.Sprintf("%s", f.Bytes()[q0:q1])
+			if err := limitsOf(f).print(len(str)); err != nil {
+				return err
+			}
 			p.Options.Sender.Send(Print(str))
+			return nil
 		}
 		return
 	case "a":
@@ -204,37 +324,69 @@ func parseCmd(p *parser) (c *Command) {
 		c.fn = Delete{}.Apply
 		return
 	case "e":
+		name := p.fileOrOrigin(v, parseArg(p))
+		c.fn = func(f Editor) error {
+			s, err := name(f)
+			if err != nil {
+				return err
+			}
+			return Edit{Name: s}.Apply(f)
+		}
+		return
 	case "k":
+		name := byte('\'')
+		if v := parseArg(p); v != "" {
+			name = v[0]
+		}
+		c.fn = func(f Editor) error {
+			q0, q1 := f.Dot()
+			(*p.marks)[name] = Dot{q0, q1}
+			return nil
+		}
+		return
 	case "r":
-		c.fn = ReadFile{Name: parseArg(p)}.Apply
+		c.fn = ReadFile{Name: p.file(v, parseArg(p))}.Apply
+		return
+	case "u":
+		n := int64(1)
+		if v := parseArg(p); v != "" {
+			n = p.mustatoi(v)
+		}
+		c.fn = func(f Editor) error {
+			if p.undo.Undo == nil {
+				return ErrNoUndo
+			}
+			p.undo.n += int(n)
+			return nil
+		}
 		return
 	case "s":
 
 		matchn := int64(1)
-		sre := parseArg(p)
-		if p.tok.kind == kindCount {
-			matchn = p.mustatoi(sre)
-			sre = parseArg(p)
+		if p.Next(); p.tok.kind == kindCount {
+			matchn = p.mustatoi(p.tok.value)
+			p.Next()
+		}
+		if p.tok.kind != kindArg {
+			p.fatal(fmt.Errorf("s: want regexp, have %q", p.tok.value))
+			return nil
 		}
-		replamp := compileReplaceAmp(parseArg(p))
+		sre := p.tok.value
+		repl := parseArg(p)
+		replTok := p.tok
 
 		// And at this point I realized that instead
 		// of a one token look-ahead parser, I have
 		// a one token look-behind parser. How unfortunate.
 		//
-		// TODO(as): check for 'g' here after fixing the parser
-		// try parsing the last part of the construction anyway
-		// and look for 'g'
-		if g := parseArg(p); p.tok.kind == kindGlobal {
-			if g != "g" {
-				p.fatal("s: suffix not supported: " + g)
-				return
-			}
+		// The lexer always emits the suffix, even when it's
+		// empty, so it can be consumed unconditionally.
+		if p.Next(); p.tok.kind == kindGlobal && p.tok.value == "g" {
 			matchn = -1
 		}
 		if sre == "" {
-			eprint("s: no regexp to find")
-			return
+			p.fatal(fmt.Errorf("s: no regexp to find"))
+			return nil
 		}
 
 		re, err := regexp.Compile(sre)
@@ -242,6 +394,11 @@ func parseCmd(p *parser) (c *Command) {
 			p.fatal(err)
 			return
 		}
+		replamp, err := compileReplaceAmp(repl, re)
+		if err != nil {
+			p.fatalAt(replTok, err)
+			return nil
+		}
 		c.fn = S{
 			Regexp:     re,
 			ReplaceAmp: replamp,
@@ -249,27 +406,148 @@ func parseCmd(p *parser) (c *Command) {
 		}.Apply
 		return
 	case "w":
-		c.fn = WriteFile{Name: parseArg(p)}.Apply
+		arg := parseArg(p)
+		name := p.fileOrOrigin(v, arg)
+		whole := !p.addressed
+		c.fn = func(f Editor) error {
+			s, err := name(f)
+			if err != nil {
+				return err
+			}
+			w := WriteFile{Name: s}
+			q0, q1 := f.Dot()
+			if whole {
+				// Without an address, w writes the whole file
+				f.Select(0, f.Len())
+				err = w.Apply(f)
+				f.Select(q0, q1)
+				q0, q1 = 0, f.Len()
+			} else {
+				err = w.Apply(f)
+			}
+			if err != nil {
+				return err
+			}
+			if arg == "" && q0 == 0 && q1 == f.Len() {
+				// Writing all of the file being edited saves it
+				if r := workspaceOf(f); r != nil && r.file != nil {
+					r.file.Modified = false
+				}
+			}
+			return nil
+		}
+		return
+	case "X", "Y":
+		var re *regexp.Regexp
+		if arg := parseArg(p); arg != "" {
+			var err error
+			if re, err = regexp.Compile(arg); err != nil {
+				p.fatal(err)
+				return
+			}
+		}
+		c.fn = func(f Editor) error {
+			r := workspaceOf(f)
+			if r == nil {
+				return ErrNoWorkspace
+			}
+			return r.loop(f, c, func(name string) bool {
+				if re == nil {
+					return v == "X"
+				}
+				return re.MatchString(name) == (v == "X")
+			}, p.errs)
+		}
+		return
+	case "b", "B", "D":
+		names := strings.Fields(parseArg(p))
+		if v == "b" && len(names) != 1 {
+			p.fatal(fmt.Errorf("b: want one file name"))
+			return
+		}
+		for i, name := range names {
+			if v == "B" {
+				names[i] = p.file(v, name)
+			} else {
+				names[i] = p.path(name)
+			}
+		}
+		c.fn = func(f Editor) error {
+			r := workspaceOf(f)
+			if r == nil {
+				return ErrNoWorkspace
+			}
+			switch v {
+			case "b":
+				return r.ws.Select(names[0])
+			case "B":
+				return r.ws.open(names)
+			}
+			return r.ws.remove(names)
+		}
+		return
+	case "f":
+		name := strings.TrimSpace(parseArg(p))
+		if name != "" {
+			name = p.path(name)
+		}
+		c.fn = func(f Editor) error {
+			r := workspaceOf(f)
+			if r == nil {
+				return ErrNoWorkspace
+			}
+			if name != "" {
+				if err := r.ws.Rename(r.ws.cur, name); err != nil {
+					return err
+				}
+			}
+			if r.ws.cur != nil {
+				p.send(f, r.ws.status(r.ws.cur))
+			}
+			return nil
+		}
+		return
+	case "n":
+		c.fn = func(f Editor) error {
+			r := workspaceOf(f)
+			if r == nil {
+				return ErrNoWorkspace
+			}
+			for _, file := range r.ws.files {
+				if err := p.send(f, r.ws.status(file)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
 		return
 	case "m":
+		p.Next()
 		a1 := parseSimpleAddr(p)
-		c.fn = func(f Editor) {
+		c.fn = func(f Editor) error {
 			q0, q1 := f.Dot()
 			p := append([]byte{}, f.Bytes()[q0:q1]...)
-			a1.Set(f)
+			if err := a1.Set(f); err != nil {
+				return err
+			}
 			_, a1 := f.Dot()
 			f.Delete(q0, q1)
 			f.Insert(p, a1)
+			return nil
 		}
 		return
 	case "t":
+		p.Next()
 		a1 := parseSimpleAddr(p)
-		c.fn = func(f Editor) {
+		c.fn = func(f Editor) error {
 			q0, q1 := f.Dot()
 			p := f.Bytes()[q0:q1]
-			a1.Set(f)
+			if err := a1.Set(f); err != nil {
+				return err
+			}
 			_, a1 := f.Dot()
 			f.Insert(p, a1)
+			return nil
 		}
 		return
 	case "g":
@@ -278,13 +556,14 @@ func parseCmd(p *parser) (c *Command) {
 			p.fatal(err)
 			return
 		}
-		c.fn = func(f Editor) {
+		c.fn = func(f Editor) error {
 			q0, q1 := f.Dot()
 			if re.Match(f.Bytes()[q0:q1]) {
 				if nextfn := c.nextFn(); nextfn != nil {
-					nextfn(f)
+					return nextfn(f)
 				}
 			}
+			return nil
 		}
 		return
 	case "v":
@@ -293,32 +572,34 @@ func parseCmd(p *parser) (c *Command) {
 			p.fatal(err)
 			return
 		}
-		c.fn = func(f Editor) {
+		c.fn = func(f Editor) error {
 			q0, q1 := f.Dot()
 			if !re.Match(f.Bytes()[q0:q1]) {
 				if nextfn := c.nextFn(); nextfn != nil {
-					nextfn(f)
+					return nextfn(f)
 				}
 			}
+			return nil
 		}
 		return
 	case "|":
-		c.fn = Pipe{To: parseArg(p)}.Apply
+		c.fn = Pipe{To: p.exec(v, p.expand(parseArg(p)))}.Apply
+		return
+	case "<":
+		c.fn = Input{From: p.exec(v, p.expand(parseArg(p)))}.Apply
+		return
+	case "!":
+		sh := Shell{Cmd: p.exec(v, p.expand(parseArg(p)))}
+		if p.Options != nil {
+			sh.Sender = p.Options.Sender
+		}
+		c.fn = sh.Apply
 		return
 	case ">":
-		filename := parseArg(p)
-		c.fn = func(f Editor) {
-			fd, err := os.Create(filename)
-			if err != nil {
-				eprint(err)
-				return
-			}
-			defer fd.Close()
+		filename := p.expandFile(v, strings.TrimSpace(parseArg(p)))
+		c.fn = func(f Editor) error {
 			q0, q1 := f.Dot()
-			_, err = io.Copy(fd, bytes.NewReader(f.Bytes()[q0:q1]))
-			if err != nil {
-				eprint(err)
-			}
+			return fsOf(f).WriteFile(filename, f.Bytes()[q0:q1])
 		}
 		return
 	case "x":
@@ -328,22 +609,31 @@ func parseCmd(p *parser) (c *Command) {
 			return
 		}
 		buf := new(bytes.Reader)
-		c.fn = func(f Editor) {
-
+		c.fn = func(f Editor) error {
+			ctx, lim := contextOf(f), limitsOf(f)
 			sp, ep := f.Dot()
 			buf.Reset(f.Bytes()[sp:ep])
 			q0 := int64(0)
 			for {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
 				loc := re.FindReaderIndex(buf)
 				if loc == nil {
 					break
 				}
+				if err := lim.loop(); err != nil {
+					return err
+				}
 				q1 := q0 + int64(loc[1])
 				q0 += int64(loc[0])
 				//				log.Printf("match: %q location (%d,%d)", f.Bytes()[sp+q0:sp+q1], sp+q0, sp+q1)
 				f.Select(sp+q0, sp+q1)
+				nextMatch(f)
 				if nextfn := c.nextFn(); nextfn != nil {
-					nextfn(f)
+					if err := nextfn(f); err != nil {
+						p.errs.add(err)
+					}
 				}
 				q0 = q1
 				buf.Seek(q0, 0)
@@ -352,6 +642,7 @@ func parseCmd(p *parser) (c *Command) {
 				}
 			}
 			f.Select(ep, ep)
+			return nil
 		}
 		return
 	case "y":
@@ -360,131 +651,382 @@ func parseCmd(p *parser) (c *Command) {
 			p.fatal(err)
 			return
 		}
-		c.fn = func(f Editor) {
+		c.fn = func(f Editor) error {
 			q0, q1 := f.Dot()
 			x0, x1 := int64(0), int64(0)
 			y0, y1 := int64(0), q1
 			buf := bytes.NewReader(f.Bytes()[q0:q1])
+			ctx, lim := contextOf(f), limitsOf(f)
 			for {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
 				loc := re.FindReaderIndex(buf)
 				if loc == nil {
 					buf.Seek(x1, 0)
-					eprint("not found")
 					break
 				}
+				if err := lim.loop(); err != nil {
+					return err
+				}
 				y0 = x1
 				x0, x1 = int64(loc[0])+x1, int64(loc[1])+x1
 				y1 = x0
 				f.Select(q0+y0, q0+y1)
+				nextMatch(f)
 				if nextfn := c.nextFn(); nextfn != nil {
-					nextfn(f)
+					if err := nextfn(f); err != nil {
+						p.errs.add(err)
+					}
 				}
 				buf.Seek(x1, 0)
 			}
-			if x1 != q1 {
+			if q0+x1 != q1 {
 				f.Select(q0+x1, q1)
+				nextMatch(f)
 				if nextfn := c.nextFn(); nextfn != nil {
-					nextfn(f)
+					return nextfn(f)
 				}
 			}
+			return nil
 		}
 		return
 	}
 	return nil
 }
 
-type ReplaceAmp []func([]byte) string
+// ReplaceAmp is a compiled replacement for the s command. Each
+// function returns part of the replacement given the text that
+// was searched and the submatch indices of the match in it.
+type ReplaceAmp []func(src []byte, m []int) string
 
 func (r ReplaceAmp) Run(ed Editor, q1 int64, sel []byte) (n int) {
+	m := []int{0, len(sel)}
 	for _, fn := range r {
-		b := []byte(fn(sel))
+		b := []byte(fn(sel, m))
 		n += len(b)
 		ed.Insert(b, q1)
 	}
 	return n
 }
+
+// Gen returns the replacement for a match of the entire
+// slice. Submatch references expand to nothing.
 func (r ReplaceAmp) Gen(replace []byte) (b []byte) {
+	return r.Expand(replace, []int{0, len(replace)})
+}
+
+// Expand returns the replacement for the match in src described
+// by the submatch indices m, as returned by FindSubmatchIndex.
+func (r ReplaceAmp) Expand(src []byte, m []int) (b []byte) {
 	for _, fn := range r {
-		b = append(b, fn(replace)...)
+		b = append(b, fn(src, m)...)
 	}
 	return b
 }
-func compileReplaceAmp(in string) (s ReplaceAmp) {
-	// we can use strings.Map but then invalid runes
-	// are replaced. we'll do it the old fashioned
-	// way for now
 
-	// strings are immutable, but this is faster than
-	// the string 'builders' on platforms tested
-	for {
-		i := strings.Index(in, `&`)
-		if i == -1 {
-			s = append(s, func([]byte) string { return in })
+// compileReplaceAmp compiles the replacement text of an s command
+// whose regexp is re. An & is the entire match, \1 through \9 are
+// submatches, and \{name} is the submatch with that name. A \& is
+// a literal ampersand and a \\ is a literal backslash. Go escape
+// sequences like \n and \t are replaced with their characters, and a
+// backslash before any other character is removed.
+func compileReplaceAmp(in string, re *regexp.Regexp) (s ReplaceAmp, err error) {
+	var lit []byte
+	flush := func() {
+		if len(lit) == 0 {
 			return
 		}
-		if i > 0 && in[i] == '\\' {
-			s = append(s, func(b []byte) string { return in[:i-2] })
-			s = append(s, func(b []byte) string { return "&" })
-			i += 2
-		} else {
-			s = append(s, func(b []byte) string { return in[:i-1] })
-			s = append(s, func(b []byte) string { return string(b) })
+		str := string(lit)
+		s = append(s, func([]byte, []int) string { return str })
+		lit = nil
+	}
+	group := func(n int) {
+		flush()
+		s = append(s, func(src []byte, m []int) string {
+			if 2*n+1 >= len(m) || m[2*n] < 0 {
+				return ""
+			}
+			return string(src[m[2*n]:m[2*n+1]])
+		})
+	}
+	for i := 0; i < len(in); {
+		c := in[i]
+		if c == '&' {
+			group(0)
 			i++
+			continue
 		}
-		if i == len(in) {
-			break
+		if c != '\\' || i+1 == len(in) {
+			lit = append(lit, c)
+			i++
+			continue
+		}
+		switch d := in[i+1]; {
+		case d == '&', d == '\\':
+			lit = append(lit, d)
+			i += 2
+		case '1' <= d && d <= '9':
+			n := int(d - '0')
+			if n > re.NumSubexp() {
+				return nil, fmt.Errorf("s: no submatch \\%d in %q", n, re)
+			}
+			group(n)
+			i += 2
+		case d == '{':
+			j := strings.IndexByte(in[i:], '}')
+			if j == -1 {
+				return nil, fmt.Errorf("s: missing } in %q", in[i:])
+			}
+			n := subexpIndex(re, in[i+2:i+j])
+			if n == -1 {
+				return nil, fmt.Errorf("s: no submatch %s in %q", in[i:i+j+1], re)
+			}
+			group(n)
+			i += j + 1
+		default:
+			r, _, tail, err := strconv.UnquoteChar(in[i:], 0)
+			if err != nil {
+				lit = append(lit, d)
+				i += 2
+				break
+			}
+			lit = append(lit, string(r)...)
+			i = len(in) - len(tail)
 		}
-		in = in[i:]
 	}
+	flush()
 	if s == nil {
-		s = append(s, func(b []byte) string { return "" })
+		s = append(s, func([]byte, []int) string { return "" })
 	}
-	return
+	return s, nil
+}
+
+// subexpIndex returns the index of the submatch called name, which
+// may also be a number. It returns -1 if there is no such submatch.
+func subexpIndex(re *regexp.Regexp, name string) int {
+	if n, err := strconv.Atoi(name); err == nil {
+		if n < 0 || n > re.NumSubexp() {
+			return -1
+		}
+		return n
+	}
+	for i, v := range re.SubexpNames() {
+		if v != "" && v == name {
+			return i
+		}
+	}
+	return -1
 }
+
 func (p *parser) Next() *item {
 	p.last = p.tok
-	p.tok = <-p.in
+	tok, ok := <-p.in
+	if !ok {
+		tok = item{kind: kindEof, pos: len(p.prog)}
+	}
+	p.tok = tok
+	if tok.kind == kindErr {
+		p.fatal(errors.New(tok.value))
+	}
 	return &p.tok
 }
 
 func (p *parser) run() {
-	tok := p.Next()
-	if tok.kind == kindEof || p.err != nil {
-		if tok.kind == kindEof {
-			p.fatal(fmt.Errorf("run: unexpected eof"))
-			return
-		}
-		p.fatal(fmt.Errorf("run: %s", p.err))
-		return
+	defer close(p.stop)
+	p.Next()
+	for p.tok.kind != kindEof && p.err == nil {
+		p.lines = append(p.lines, parseLine(p))
 	}
-	p.addr = parseAddr(p)
+	p.stop <- p.err
+}
+
+// parseLine parses an address and its commands up to the end
+// of the line
+func parseLine(p *parser) *line {
+	ln := &line{pos: p.tok.pos}
+	p.addressed = p.tok.kind != kindDot || p.tok.value != ""
+	ln.addr = parseAddr(p)
 	for {
+		switch p.tok.kind {
+		case kindNewline:
+			p.Next()
+			return ln
+		case kindEof:
+			return ln
+		}
 		c := parseCmd(p)
+		p.addressed = false
 		if c == nil {
-			break
+			p.fatal(fmt.Errorf("unknown command %q", p.tok.value))
+			return ln
+		}
+		if c.s == "X" || c.s == "Y" {
+			// The command run in each file ends the line
+			p.Next()
+			if c.next = parseElem(p); c.next == nil {
+				p.fatal(fmt.Errorf("unknown command %q", p.tok.value))
+				return ln
+			}
+			if p.Next(); p.tok.kind != kindNewline && p.tok.kind != kindEof {
+				p.fatal(fmt.Errorf("%s: unexpected %q", c.s, p.tok.value))
+				return ln
+			}
+		}
+		if c.fn != nil {
+			guard(c, p.owners)
+		}
+		ln.cmd = append(ln.cmd, c)
+		if c.next != nil {
+			continue
 		}
-		p.cmd = append(p.cmd, c)
 		p.Next()
 	}
-	p.stop <- p.err
-	close(p.stop)
+}
+
+// file returns the file name used by cmd, after checking
+// that the sandbox allows it. A relative name is resolved
+// against the directory of the file being edited. With
+// Options.FS, the name is made a valid fs.FS path.
+func (p *parser) file(cmd, name string) string {
+	if p.Options == nil {
+		return name
+	}
+	return p.allowFile(cmd, p.resolve(name))
+}
+
+// allowFile returns the resolved name as file does, after checking
+// that the sandbox allows cmd to use it
+func (p *parser) allowFile(cmd, name string) string {
+	if err := p.Options.Sandbox.allowFile(cmd, name, p.Options.FS == nil); err != nil {
+		p.fatal(err)
+	}
+	return p.fsPath(name)
+}
+
+// expandFile is like file, but expands $% in name first. A name
+// starting with $% is already relative to the working directory,
+// as the name of the file being edited is, so it isn't joined to
+// that file's directory again.
+func (p *parser) expandFile(cmd, name string) string {
+	if p.Options == nil || !strings.HasPrefix(name, "$%") {
+		return p.file(cmd, p.expand(name))
+	}
+	return p.allowFile(cmd, p.expand(name))
+}
+
+// fileOrOrigin returns a function that returns the file name
+// used by cmd when it runs on an Editor. A name is checked and
+// resolved as file does, when the program is compiled. An empty
+// name is the name of the file being edited, which is looked up
+// when cmd runs: in a workspace, it is the file cmd runs on.
+func (p *parser) fileOrOrigin(cmd, name string) func(f Editor) (string, error) {
+	if name != "" {
+		name = p.file(cmd, name)
+		return func(Editor) (string, error) {
+			return name, nil
+		}
+	}
+	return func(f Editor) (string, error) {
+		origin := ""
+		if p.Options != nil {
+			origin = p.Options.Origin
+		}
+		if r := workspaceOf(f); r != nil {
+			origin = ""
+			if r.file != nil {
+				origin = r.file.Name
+			}
+		}
+		if origin == "" {
+			return "", fmt.Errorf("%s: no file name", cmd)
+		}
+		origin = filepath.Clean(origin)
+		if p.Options == nil {
+			return origin, nil
+		}
+		if err := p.Options.Sandbox.allowFile(cmd, origin, p.Options.FS == nil); err != nil {
+			return "", err
+		}
+		return p.fsPath(origin), nil
+	}
+}
+
+// path returns name as file does, without checking the sandbox
+func (p *parser) path(name string) string {
+	if p.Options == nil {
+		return name
+	}
+	return p.fsPath(p.resolve(name))
+}
+
+// resolve joins a relative name to the directory of the file
+// being edited
+func (p *parser) resolve(name string) string {
+	if o := p.Options.Origin; o != "" && !filepath.IsAbs(name) {
+		name = filepath.Join(filepath.Dir(o), name)
+	}
+	return name
+}
+
+// fsPath makes name a valid fs.FS path if Options.FS is set
+func (p *parser) fsPath(name string) string {
+	if p.Options.FS != nil {
+		name = strings.TrimPrefix(path.Clean(filepath.ToSlash(name)), "/")
+	}
+	return name
+}
+
+// send sends s to the Sender, if there is one, as p and =
+// do
+func (p *parser) send(f Editor, s string) error {
+	if p.Options == nil || p.Options.Sender == nil {
+		return nil
+	}
+	if err := limitsOf(f).print(len(s)); err != nil {
+		return err
+	}
+	p.Options.Sender.Send(Print(s))
+	return nil
+}
+
+// exec returns the command line run by cmd, after checking
+// that the sandbox allows it
+func (p *parser) exec(cmd, line string) string {
+	line = strings.TrimSpace(line)
+	if p.Options != nil {
+		if err := p.Options.Sandbox.allowExec(cmd, line); err != nil {
+			p.fatal(err)
+		}
+	}
+	return line
+}
+
+// expand replaces $% in s with the name of the file being edited
+func (p *parser) expand(s string) string {
+	origin := ""
+	if p.Options != nil {
+		origin = p.Options.Origin
+	}
+	return strings.Replace(s, "$%", origin, -1)
 }
 
 func (p *parser) mustatoi(s string) int64 {
-	i, err := strconv.Atoi(s)
+	i, err := strconv.ParseInt(s, 10, 64)
 	if err != nil {
 		p.fatal(err)
 	}
-	return int64(i)
+	return i
 }
-func (p *parser) fatal(why interface{}) {
-	switch why := why.(type) {
-	default:
-		//fmt.Println(why)
-		_ = why
-	}
+
+// fatal records the first error found while parsing. The
+// error is located at the current token.
+func (p *parser) fatal(err error) {
+	p.fatalAt(p.tok, err)
 }
 
-func n(i ...interface{}) (n int, err error) {
-	return
+func (p *parser) fatalAt(tok item, err error) {
+	if p.err == nil {
+		p.err = newSyntaxError(p.prog, tok, err.Error())
+	}
 }
@@ -1,5 +1,10 @@
 package edit
 
+import (
+	"context"
+	"io"
+)
+
 // Recorder is an overlay over an Editor that prevents mutable
 // changes from occuring.
 type Recorder struct {
@@ -18,3 +23,77 @@ func (r *Recorder) Insert(p []byte, at int64) (n int) {
 func (r *Recorder) Delete(q0, q1 int64) (n int) {
 	return int(q1 - q0)
 }
+
+// runEditor is the Editor the commands of a run operate on. It
+// carries the run's context, file system, executor and
+// workspace, and counts the work done against the run's limits.
+type runEditor struct {
+	Editor
+	ctx  context.Context
+	lim  *budget
+	fs   FS
+	exec Executor
+	ws   *wsRun
+	own  *owners
+}
+
+// WriteAt writes p over the text at at unless that exceeds the
+// limit on the bytes inserted
+func (r *runEditor) WriteAt(p []byte, at int64) (int, error) {
+	if err := r.lim.insert(len(p)); err != nil {
+		return 0, err
+	}
+	return r.Editor.(io.WriterAt).WriteAt(p, at)
+}
+
+// Insert inserts p unless that exceeds the limit on the
+// bytes inserted
+func (r *runEditor) Insert(p []byte, at int64) int {
+	if r.lim.insert(len(p)) != nil {
+		return 0
+	}
+	return r.Editor.Insert(p, at)
+}
+
+// stopped returns the reason the run must stop early, if any
+func (r *runEditor) stopped() error {
+	if r == nil {
+		return nil
+	}
+	if err := r.ctx.Err(); err != nil {
+		return err
+	}
+	return r.lim.err
+}
+
+// runOf returns the run using ed, or nil if there is none
+func runOf(ed Editor) *runEditor {
+	r, _ := ed.(*runEditor)
+	return r
+}
+
+// contextOf returns the context of the run using ed
+func contextOf(ed Editor) context.Context {
+	if r := runOf(ed); r != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// nextMatch tells the run using ed that a loop has moved on to
+// its next match, so the changes made for each match can be told
+// apart
+func nextMatch(ed Editor) {
+	if r := runOf(ed); r != nil && r.own != nil {
+		r.own.match++
+	}
+}
+
+// limitsOf returns the budget of the run using ed. Outside
+// of a run the budget is unlimited.
+func limitsOf(ed Editor) *budget {
+	if r := runOf(ed); r != nil {
+		return r.lim
+	}
+	return &budget{}
+}
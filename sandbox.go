@@ -0,0 +1,105 @@
+package edit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Sandbox restricts the commands that reach outside the text
+// being edited. A program that uses a command the sandbox
+// doesn't allow fails to compile.
+type Sandbox struct {
+	// Files lists the files that e, r, w and > may use. An
+	// entry is a file name or a filepath.Match pattern. If
+	// Files is empty, those commands are rejected. Unless
+	// Options.FS is set, the name with its symbolic links
+	// followed must be allowed too.
+	Files []string
+
+	// Exec lists the programs that |, < and ! may run. An
+	// entry is a program name or a filepath.Match pattern
+	// matched against the first word of the command line.
+	// Lines that use shell syntax outside of single quotes
+	// are rejected, since they could run other programs. If
+	// Exec is empty, those commands are rejected.
+	Exec []string
+}
+
+// allowFile returns an error unless the sandbox lets cmd
+// use the named file. If local is set, the name is one on the
+// operating system and it must also be allowed with its symbolic
+// links followed, so a link can't lead outside the allowed files.
+func (s *Sandbox) allowFile(cmd, name string, local bool) error {
+	if s == nil {
+		return nil
+	}
+	if !match(s.Files, filepath.Clean(name)) {
+		if len(s.Files) == 0 {
+			return fmt.Errorf("sandbox: %s: file commands are disabled", cmd)
+		}
+		return fmt.Errorf("sandbox: %s: file %q is not allowed", cmd, name)
+	}
+	if !local {
+		return nil
+	}
+	real, err := realPath(name)
+	if err != nil {
+		return fmt.Errorf("sandbox: %s: %v", cmd, err)
+	}
+	if !match(s.Files, real) {
+		return fmt.Errorf("sandbox: %s: file %q links to %q, which is not allowed", cmd, name, real)
+	}
+	return nil
+}
+
+// realPath returns name with its symbolic links followed. A file
+// that doesn't exist is created in its directory, so the links of
+// the directory are followed instead.
+func realPath(name string) (string, error) {
+	real, err := filepath.EvalSymlinks(name)
+	if !os.IsNotExist(err) {
+		return real, err
+	}
+	if fi, err := os.Lstat(name); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		return "", fmt.Errorf("%q is a broken link", name)
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(name))
+	if os.IsNotExist(err) {
+		// There is no file to write either
+		return filepath.Clean(name), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(name)), nil
+}
+
+// allowExec returns an error unless the sandbox lets cmd
+// run the command line s
+func (s *Sandbox) allowExec(cmd, line string) error {
+	if s == nil {
+		return nil
+	}
+	if len(s.Exec) == 0 {
+		return fmt.Errorf("sandbox: %s: subprocesses are disabled", cmd)
+	}
+	name, ok := simpleCommand(line)
+	if !ok {
+		return fmt.Errorf("sandbox: %s: command %q uses shell syntax", cmd, line)
+	}
+	if name != "" && match(s.Exec, name) {
+		return nil
+	}
+	return fmt.Errorf("sandbox: %s: command %q is not allowed", cmd, line)
+}
+
+// match reports whether name matches one of the patterns
+func match(patterns []string, name string) bool {
+	for _, pat := range patterns {
+		if ok, _ := filepath.Match(filepath.Clean(pat), name); ok {
+			return true
+		}
+	}
+	return false
+}
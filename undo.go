@@ -0,0 +1,154 @@
+package edit
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/as/event"
+	"github.com/as/worm"
+)
+
+var ErrNoUndo = errors.New("no undo history")
+
+// Invert returns the transaction that reverses log. The log must
+// hold changes recorded against the current contents of ed, as
+// returned by Transcribe, so Invert has to be called before the
+// log is committed. The inverse is recorded against the contents
+// ed has after the commit, and committing it restores them.
+func Invert(ed Editor, log worm.Logger) (inv worm.Logger, err error) {
+	ev, err := readEvents(log)
+	if err != nil {
+		return nil, err
+	}
+	p := ed.Bytes()
+	inside := func(q0, q1 int64) bool {
+		return 0 <= q0 && q0 <= q1 && q1 <= int64(len(p))
+	}
+	clone := func(q0, q1 int64) []byte {
+		return append([]byte{}, p[q0:q1]...)
+	}
+
+	// The events are in address order, so each one is shifted by
+	// the size of the changes before it
+	inv = worm.NewLogger()
+	shift := int64(0)
+	for _, e := range ev {
+		switch t := e.(type) {
+		case *event.Insert:
+			if !inside(t.Q0, t.Q0) {
+				return nil, fmt.Errorf("invert: insert at #%d out of range", t.Q0)
+			}
+			n := int64(len(t.P))
+			inv.Write(&event.Delete{Q0: t.Q0 + shift, Q1: t.Q0 + shift + n})
+			shift += n
+		case *event.Write:
+			q1 := t.Q0 + int64(len(t.P))
+			if !inside(t.Q0, q1) {
+				return nil, fmt.Errorf("invert: write at #%d,#%d out of range", t.Q0, q1)
+			}
+			inv.Write(&event.Write{Q0: t.Q0 + shift, Q1: q1 + shift, P: clone(t.Q0, q1)})
+		case *event.Delete:
+			if !inside(t.Q0, t.Q1) {
+				return nil, fmt.Errorf("invert: delete of #%d,#%d out of range", t.Q0, t.Q1)
+			}
+			inv.Write(&event.Insert{Q0: t.Q0 + shift, Q1: t.Q1 + shift, P: clone(t.Q0, t.Q1)})
+			shift -= t.Q1 - t.Q0
+		}
+	}
+	return inv, nil
+}
+
+// Undo is a history of the transactions committed to an Editor.
+// Each transaction can be undone and redone as a unit.
+type Undo struct {
+	ed   Editor
+	undo []worm.Logger // inverses of the committed transactions
+	redo []worm.Logger // inverses of the undone transactions
+}
+
+// NewUndo returns an empty history for ed
+func NewUndo(ed Editor) *Undo {
+	return &Undo{ed: ed}
+}
+
+// Len returns the number of transactions that can be undone
+// and redone
+func (u *Undo) Len() (undo, redo int) {
+	return len(u.undo), len(u.redo)
+}
+
+// Commit commits the transaction in log to the editor and pushes
+// it onto the history. The transactions undone before it can no
+// longer be redone.
+func (u *Undo) Commit(log worm.Logger) error {
+	return u.commit(log, marksOf(u.ed, nil))
+}
+
+func (u *Undo) commit(log worm.Logger, marks Marks) error {
+	inv, err := Invert(u.ed, log)
+	if err != nil {
+		return err
+	}
+	if err = commit(u.ed, log, marks); err != nil {
+		return err
+	}
+	if log.Len() != 0 {
+		u.undo = append(u.undo, inv)
+		u.redo = nil
+	}
+	return nil
+}
+
+// Run runs c on the editor and commits its transaction to the
+// history. The u commands in c undo and redo transactions from
+// the history.
+func (u *Undo) Run(c *Command) error {
+	c.undo.Undo = u
+	defer func() { c.undo.Undo = nil }()
+	return c.Run(u.ed)
+}
+
+// Undo undoes the last n transactions, or redoes the last -n
+// transactions undone if n is negative. It stops early when
+// the history runs out.
+func (u *Undo) Undo(n int) error {
+	for ; n > 0 && len(u.undo) > 0; n-- {
+		if err := u.step(&u.undo, &u.redo); err != nil {
+			return err
+		}
+	}
+	for ; n < 0 && len(u.redo) > 0; n++ {
+		if err := u.step(&u.redo, &u.undo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Redo redoes the last n transactions undone
+func (u *Undo) Redo(n int) error {
+	return u.Undo(-n)
+}
+
+// step commits the transaction on top of from and pushes
+// its inverse onto to
+func (u *Undo) step(from, to *[]worm.Logger) error {
+	log := (*from)[len(*from)-1]
+	inv, err := Invert(u.ed, log)
+	if err != nil {
+		return err
+	}
+	if err = commit(u.ed, log, marksOf(u.ed, nil)); err != nil {
+		return err
+	}
+	*from = (*from)[:len(*from)-1]
+	*to = append(*to, inv)
+	return nil
+}
+
+// undoer holds the history a program runs with and the number
+// of transactions its u commands want undone
+type undoer struct {
+	*Undo
+	n int
+}
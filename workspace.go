@@ -0,0 +1,362 @@
+package edit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+
+	"github.com/as/text"
+)
+
+var (
+	ErrNoWorkspace = errors.New("no workspace")
+	ErrNoFile      = errors.New("no current file")
+)
+
+// File is a named Editor in a Workspace
+type File struct {
+	Name   string
+	Editor Editor
+
+	// Modified is set when a program changes the file, and
+	// cleared when w writes all of it to its name
+	Modified bool
+
+	// Undo, if not nil, is the file's history. Programs commit
+	// their changes to it, and their u commands undo them.
+	Undo *Undo
+
+	marks Marks // the marks set by k, if Editor isn't a Marker
+}
+
+// Workspace is a set of files edited together, one of which is
+// current. Programs run on a workspace can use sam's file
+// commands:
+//
+//	X/re/ cmd	run cmd in each file whose name matches re
+//	Y/re/ cmd	run cmd in each file whose name doesn't match re
+//	b file	make file current
+//	B files...	add files and make the last one current
+//	D files...	remove files, or the current file
+//	f name	rename the current file and print its status
+//	n	print the status of each file
+//
+// Without a regexp, X runs cmd in every file and Y in none. The
+// command run by X and Y may have its own address, which is
+// evaluated in each file. The status of a file is a quote if it
+// was modified, a period if it's current, and its name.
+type Workspace struct {
+	// Options are the options programs are compiled with. The
+	// Origin is replaced with the name of the file a program
+	// runs on, so relative names and $% refer to that file.
+	Options *Options
+
+	// Open returns the Editor for a file added by B. If nil,
+	// the file is read from Options.FS or the operating system
+	// into a new buffer, which is empty if the file doesn't
+	// exist.
+	Open func(name string) (Editor, error)
+
+	files []*File // sorted by name
+	cur   *File
+}
+
+// NewWorkspace returns an empty workspace
+func NewWorkspace(opts ...*Options) *Workspace {
+	w := &Workspace{}
+	if len(opts) != 0 {
+		w.Options = opts[0]
+	}
+	return w
+}
+
+// Add adds ed to the workspace as the named file and makes it
+// current. It replaces any file with the same name.
+func (w *Workspace) Add(name string, ed Editor) *File {
+	f := &File{Name: name, Editor: ed}
+	if i, ok := w.index(name); ok {
+		w.files[i] = f
+	} else {
+		w.files = append(w.files, nil)
+		copy(w.files[i+1:], w.files[i:])
+		w.files[i] = f
+	}
+	w.cur = f
+	return f
+}
+
+// Lookup returns the named file, or nil if there is none
+func (w *Workspace) Lookup(name string) *File {
+	if i, ok := w.index(name); ok {
+		return w.files[i]
+	}
+	return nil
+}
+
+// Files returns the files in the workspace sorted by name
+func (w *Workspace) Files() []*File {
+	return append([]*File{}, w.files...)
+}
+
+// Current returns the current file, or nil if there is none
+func (w *Workspace) Current() *File {
+	return w.cur
+}
+
+// Select makes the named file current
+func (w *Workspace) Select(name string) error {
+	f := w.Lookup(name)
+	if f == nil {
+		return fmt.Errorf("no file %q", name)
+	}
+	w.cur = f
+	return nil
+}
+
+// Remove removes the named file from the workspace without
+// closing its Editor. If the file was current, there is no
+// current file.
+func (w *Workspace) Remove(name string) error {
+	i, ok := w.index(name)
+	if !ok {
+		return fmt.Errorf("no file %q", name)
+	}
+	if w.files[i] == w.cur {
+		w.cur = nil
+	}
+	w.files = append(w.files[:i], w.files[i+1:]...)
+	return nil
+}
+
+// Rename renames f, which must be in the workspace
+func (w *Workspace) Rename(f *File, name string) error {
+	if f == nil {
+		return ErrNoFile
+	}
+	if g := w.Lookup(name); g != nil && g != f {
+		return fmt.Errorf("file %q exists", name)
+	}
+	i, ok := w.index(f.Name)
+	if !ok || w.files[i] != f {
+		return fmt.Errorf("no file %q", f.Name)
+	}
+	w.files = append(w.files[:i], w.files[i+1:]...)
+	f.Name = name
+	i, _ = w.index(name)
+	w.files = append(w.files, nil)
+	copy(w.files[i+1:], w.files[i:])
+	w.files[i] = f
+	return nil
+}
+
+// index returns where the named file is, or would be, in the
+// sorted list of files
+func (w *Workspace) index(name string) (int, bool) {
+	i := sort.Search(len(w.files), func(i int) bool {
+		return w.files[i].Name >= name
+	})
+	return i, i < len(w.files) && w.files[i].Name == name
+}
+
+// open adds the named files that aren't in the workspace and
+// makes the last one current
+func (w *Workspace) open(names []string) error {
+	for _, name := range names {
+		if w.Select(name) == nil {
+			continue
+		}
+		open := w.Open
+		if open == nil {
+			open = w.read
+		}
+		ed, err := open(name)
+		if err != nil {
+			return err
+		}
+		w.Add(name, ed)
+	}
+	return nil
+}
+
+// read reads the named file into a new buffer
+func (w *Workspace) read(name string) (Editor, error) {
+	var fsys FS = osFS{}
+	if w.Options != nil && w.Options.FS != nil {
+		fsys = w.Options.FS
+	}
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return text.Open(text.BufferFrom(data))
+}
+
+// remove removes the named files, or the current file if there
+// are no names
+func (w *Workspace) remove(names []string) error {
+	if len(names) == 0 {
+		if w.cur == nil {
+			return ErrNoFile
+		}
+		names = []string{w.cur.Name}
+	}
+	for _, name := range names {
+		if err := w.Remove(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// status returns the line describing f printed by f and n
+func (w *Workspace) status(f *File) string {
+	mod, cur := ' ', ' '
+	if f.Modified {
+		mod = '\''
+	}
+	if f == w.cur {
+		cur = '.'
+	}
+	return fmt.Sprintf("%c%c %s", mod, cur, f.Name)
+}
+
+// Run runs the program on the workspace. Each line of the
+// program runs on the file that is current when it starts, and
+// its changes to each file are committed before the next line
+// runs. Without a current file, a line can only use the file
+// commands.
+func (w *Workspace) Run(prog string) error {
+	return w.RunContext(context.Background(), prog)
+}
+
+// RunContext is like Run, but stops the program and returns
+// ctx.Err() if ctx is done before the program is
+func (w *Workspace) RunContext(ctx context.Context, prog string) error {
+	r := &wsRun{ws: w, prog: prog, ctx: ctx, cmds: map[string]*Command{}}
+	c, err := r.compile(w.cur)
+	if err != nil {
+		return err
+	}
+	for i := range c.lines {
+		r.file = w.cur
+		if c, err = r.compile(r.file); err != nil {
+			return err
+		}
+		if err = r.run(c, c.lines[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wsRun is a program running on a workspace
+type wsRun struct {
+	ws   *Workspace
+	prog string
+	ctx  context.Context
+	cmds map[string]*Command // the program compiled for each file
+	file *File               // the file being run on
+}
+
+// compile returns the program compiled for f
+func (r *wsRun) compile(f *File) (*Command, error) {
+	name := ""
+	if f != nil {
+		name = f.Name
+	}
+	if c, ok := r.cmds[name]; ok {
+		return c, nil
+	}
+	var o Options
+	if r.ws.Options != nil {
+		o = *r.ws.Options
+	}
+	o.Origin, o.PerLine = name, false
+	c, err := Compile(r.prog, &o)
+	if err != nil {
+		return nil, err
+	}
+	c.ws = r
+	if f != nil {
+		if f.marks == nil {
+			f.marks = Marks{}
+		}
+		c.own = f.marks
+		if f.Undo != nil {
+			c.undo.Undo = f.Undo
+		}
+	}
+	r.cmds[name] = c
+	return c, nil
+}
+
+// run runs fn, a part of c, on the file being run on and
+// commits its changes
+func (r *wsRun) run(c *Command, fn func(Editor) error) error {
+	f := r.file
+	var ed Editor
+	if f != nil {
+		ed = f.Editor
+	} else {
+		ed, _ = text.Open(text.NewBuffer())
+	}
+	log, err := c.record(r.ctx, ed, fn)
+	if err != nil {
+		return err
+	}
+	if log.Len() == 0 && c.undo.n == 0 {
+		return nil
+	}
+	if f == nil {
+		return ErrNoFile
+	}
+	f.Modified = true
+	return c.commit(ed, log)
+}
+
+// loop runs the command following c, an X or Y running on ed, in
+// each file whose name matches. The file being run on uses ed,
+// and the others run and commit their changes in turn.
+func (r *wsRun) loop(ed Editor, c *Command, match func(name string) bool, errs *errlist) error {
+	ctx, lim := contextOf(ed), limitsOf(ed)
+	cur := r.file
+	for _, f := range r.ws.Files() {
+		if !match(f.Name) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := lim.loop(); err != nil {
+			return err
+		}
+		if f == cur {
+			if err := c.next.fn(ed); err != nil {
+				errs.add(err)
+			}
+			continue
+		}
+		fc, err := r.compile(f)
+		if err != nil {
+			return err
+		}
+		r.file = f
+		err = r.run(fc, fc.cmds[c.next.pos].fn)
+		r.file = cur
+		if err != nil {
+			errs.add(&Error{Cmd: c.s, Pos: c.pos, Err: fmt.Errorf("%s: %v", f.Name, err)})
+		}
+	}
+	return nil
+}
+
+// workspaceOf returns the workspace run using ed, or nil if
+// there is none
+func workspaceOf(ed Editor) *wsRun {
+	if r := runOf(ed); r != nil {
+		return r.ws
+	}
+	return nil
+}